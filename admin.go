@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sathimantha/goqr/secondaryfunctions"
+	"github.com/gorilla/mux"
+)
+
+type contextKey string
+
+// adminContextKey holds the name of the authenticated staff member on admin requests
+const adminContextKey contextKey = "admin"
+
+// adminAuth only lets requests through that carry one of the ADMIN_TOKENS as a bearer token
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		admin := ""
+		for candidate, name := range secondaryfunctions.AdminConfig.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+				admin = name
+			}
+		}
+
+		if token == "" || admin == "" {
+			remark := fmt.Sprintf("Request IP: %s | Unauthorized admin request: %s %s",
+				getClientIP(r), r.Method, r.URL.Path)
+			secondaryfunctions.LogErrorContext(r.Context(), "admin_unauthorized", remark)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			sendJSONError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminContextKey, admin)))
+	})
+}
+
+// adminName returns the staff member an admin request was authenticated as
+func adminName(r *http.Request) string {
+	name, _ := r.Context().Value(adminContextKey).(string)
+	return name
+}
+
+// registerAdminRoutes sets up the authenticated routes under /api/admin
+func registerAdminRoutes(r *mux.Router) {
+	admin := r.PathPrefix("/api/admin").Subrouter()
+	admin.Use(adminAuth)
+
+	admin.HandleFunc("/students", listStudentsHandler).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/students", createStudentHandler).Methods("POST")
+	admin.HandleFunc("/students/{studentId}", getStudentHandler).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/students/{studentId}", updateStudentHandler).Methods("PUT")
+	admin.HandleFunc("/students/{studentId}", deleteStudentHandler).Methods("DELETE")
+	admin.HandleFunc("/students/{studentId}/certificates", certificateHistoryHandler).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/students/{studentId}/revoke", revokeCertificateHandler).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/students/{studentId}/reissue", reissueCertificateHandler).Methods("POST", "OPTIONS")
+	admin.HandleFunc("/students/{studentId}/events", studentEventsHandler).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/stats", eventStatsHandler).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/audit", auditTrailHandler).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/export", exportHandler).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/jobs", jobQueueHandler).Methods("GET", "OPTIONS")
+}
+
+// sendStudentError answers a failed student operation with the matching status
+func sendStudentError(w http.ResponseWriter, r *http.Request, studentId string, err error) {
+	if _, ok := err.(*secondaryfunctions.ValidationError); ok {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch err {
+	case secondaryfunctions.ErrStudentNotFound:
+		sendJSONError(w, "Student not found", http.StatusNotFound)
+	case secondaryfunctions.ErrStudentExists:
+		sendJSONError(w, "Student already exists", http.StatusConflict)
+	default:
+		remark := fmt.Sprintf("Request IP: %s | Admin %s: student operation failed for: %s | Error: %v",
+			getClientIP(r), adminName(r), studentId, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// queryInt reads a positive integer query parameter no larger than max
+func queryInt(r *http.Request, name string, defaultValue, max int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > max {
+		return 0, fmt.Errorf("%s must be between 1 and %d", name, max)
+	}
+	return n, nil
+}
+
+// listStudentsHandler returns a page of students, filtered by search term, template or course
+func listStudentsHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := queryInt(r, "page", 1, 1000000)
+	if err != nil {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	perPage, err := queryInt(r, "per_page", 50, 500)
+	if err != nil {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter := secondaryfunctions.StudentFilter{
+		Search:      r.URL.Query().Get("search"),
+		TemplateKey: r.URL.Query().Get("template"),
+		CourseID:    r.URL.Query().Get("course"),
+		Page:        page,
+		PerPage:     perPage,
+	}
+
+	students, total, err := secondaryfunctions.ListStudents(filter)
+	if err != nil {
+		sendStudentError(w, r, "", err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"students": students,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	}
+	sendJSONResponse(w, response, http.StatusOK)
+}
+
+// getStudentHandler returns a single student by ID
+func getStudentHandler(w http.ResponseWriter, r *http.Request) {
+	studentId := mux.Vars(r)["studentId"]
+
+	person, err := secondaryfunctions.GetStudent(studentId)
+	if err != nil {
+		sendStudentError(w, r, studentId, err)
+		return
+	}
+	sendJSONResponse(w, person, http.StatusOK)
+}
+
+// createStudentHandler adds a student from a JSON body
+func createStudentHandler(w http.ResponseWriter, r *http.Request) {
+	var person secondaryfunctions.Person
+	if err := json.NewDecoder(r.Body).Decode(&person); err != nil {
+		sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := secondaryfunctions.CreateStudent(&person, adminName(r), getClientIP(r)); err != nil {
+		sendStudentError(w, r, person.StudentID, err)
+		return
+	}
+	sendJSONResponse(w, person, http.StatusCreated)
+}
+
+// updateStudentHandler changes the fields present in the JSON body. Correcting
+// the name invalidates the student's cached certificate.
+func updateStudentHandler(w http.ResponseWriter, r *http.Request) {
+	studentId := mux.Vars(r)["studentId"]
+
+	var update secondaryfunctions.StudentUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	person, err := secondaryfunctions.UpdateStudent(studentId, update, adminName(r), getClientIP(r))
+	if err != nil {
+		sendStudentError(w, r, studentId, err)
+		return
+	}
+	sendJSONResponse(w, person, http.StatusOK)
+}
+
+// deleteStudentHandler removes a student; their certificates stay on record
+func deleteStudentHandler(w http.ResponseWriter, r *http.Request) {
+	studentId := mux.Vars(r)["studentId"]
+
+	if err := secondaryfunctions.DeleteStudent(studentId, adminName(r), getClientIP(r)); err != nil {
+		sendStudentError(w, r, studentId, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditTrailHandler lists recent admin changes, optionally for one student
+func auditTrailHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", 100, 1000)
+	if err != nil {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := secondaryfunctions.AuditTrail(r.URL.Query().Get("student_id"), limit)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to fetch audit trail | Error: %v", getClientIP(r), err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	sendJSONResponse(w, map[string]interface{}{"entries": entries}, http.StatusOK)
+}
+
+// jobQueueHandler reports the generation queue depth, job counts by status and
+// the most recently failed jobs
+func jobQueueHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := queryInt(r, "limit", 50, 1000)
+	if err != nil {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	counts, err := secondaryfunctions.QueueStats()
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to fetch generation queue | Error: %v", getClientIP(r), err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	failed, err := secondaryfunctions.FailedJobs(limit)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to fetch failed jobs | Error: %v", getClientIP(r), err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"depth":   counts[secondaryfunctions.JobQueued] + counts[secondaryfunctions.JobRunning],
+		"workers": secondaryfunctions.JobConfig.Workers,
+		"counts":  counts,
+		"failed":  failed,
+	}
+	sendJSONResponse(w, response, http.StatusOK)
+}
+
+// parseDateRange reads the from and to query parameters, see secondaryfunctions.ParseDateRange
+func parseDateRange(r *http.Request) (from, to time.Time, err error) {
+	return secondaryfunctions.ParseDateRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+}
+
+// eventStatsHandler counts searches, verifications and downloads in a date range
+func eventStatsHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := secondaryfunctions.GetEventStats(from, to)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to fetch event statistics | Error: %v", getClientIP(r), err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"from":   from.Format(time.RFC3339),
+		"to":     to.Format(time.RFC3339),
+		"events": stats,
+	}
+	sendJSONResponse(w, response, http.StatusOK)
+}
+
+// studentEventsHandler lists a student's most recent events, newest first
+func studentEventsHandler(w http.ResponseWriter, r *http.Request) {
+	studentId := mux.Vars(r)["studentId"]
+
+	limit, err := queryInt(r, "limit", 100, 1000)
+	if err != nil {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, err := secondaryfunctions.StudentEvents(studentId, limit)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to fetch events for student: %s | Error: %v",
+			getClientIP(r), studentId, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"student_id": studentId,
+		"events":     events,
+	}
+	sendJSONResponse(w, response, http.StatusOK)
+}
+
+// certificateHistoryHandler lists every certificate issued to a student, oldest first
+func certificateHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	studentId := mux.Vars(r)["studentId"]
+	clientIP := getClientIP(r)
+
+	history, err := secondaryfunctions.IssuanceHistory(studentId)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to fetch certificates for student: %s | Error: %v",
+			clientIP, studentId, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"student_id":   studentId,
+		"certificates": history,
+	}
+	sendJSONResponse(w, response, http.StatusOK)
+}
+
+// revokeCertificateHandler revokes a student's certificate. The body names the
+// reason and optionally the serial; without one the latest certificate is revoked.
+func revokeCertificateHandler(w http.ResponseWriter, r *http.Request) {
+	studentId := mux.Vars(r)["studentId"]
+	clientIP := getClientIP(r)
+	admin := adminName(r)
+
+	var request struct {
+		Serial string `json:"serial"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(request.Reason) == "" {
+		sendJSONError(w, "Reason is required", http.StatusBadRequest)
+		return
+	}
+
+	issuance, err := secondaryfunctions.RevokeCertificate(studentId, request.Serial, request.Reason, admin)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Admin %s failed to revoke certificate for student: %s | Serial: %s | Error: %v",
+			clientIP, admin, studentId, request.Serial, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "certificate_revocation_failure", remark)
+		switch err {
+		case secondaryfunctions.ErrCertificateNotFound:
+			sendJSONError(w, "Certificate not found", http.StatusNotFound)
+		case secondaryfunctions.ErrCertificateAlreadyRevoked:
+			sendJSONError(w, "Certificate is already revoked", http.StatusConflict)
+		default:
+			sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	changes := map[string]string{"serial": issuance.Serial, "reason": request.Reason}
+	if err := secondaryfunctions.RecordAudit(admin, secondaryfunctions.AuditCertificateRevoke, studentId, clientIP, changes); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	sendJSONResponse(w, issuance, http.StatusOK)
+}
+
+// reissueCertificateHandler issues a student a new certificate that supersedes
+// their latest one, with the template from the body or the student's record
+func reissueCertificateHandler(w http.ResponseWriter, r *http.Request) {
+	studentId := mux.Vars(r)["studentId"]
+	clientIP := getClientIP(r)
+	admin := adminName(r)
+
+	var request struct {
+		Template string `json:"template"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			sendJSONError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if request.Template != "" && !templates.Has(request.Template) {
+		sendJSONError(w, "Unknown template", http.StatusBadRequest)
+		return
+	}
+
+	person, err := secondaryfunctions.GetStudent(studentId)
+	if err != nil {
+		sendStudentError(w, r, studentId, err)
+		return
+	}
+
+	issuance, err := secondaryfunctions.ReissueCertificate(person.FullName, person.StudentID, request.Template)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Admin %s failed to reissue certificate for student: %s | Error: %v",
+			clientIP, admin, studentId, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "certificate_generation_error", remark)
+		sendJSONError(w, "Failed to generate certificate", http.StatusInternalServerError)
+		return
+	}
+
+	changes := map[string]string{"serial": issuance.Serial, "supersedes": issuance.Supersedes}
+	if err := secondaryfunctions.RecordAudit(admin, secondaryfunctions.AuditCertificateIssue, studentId, clientIP, changes); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+
+	sendJSONResponse(w, issuance, http.StatusCreated)
+}
+
+// exportContentTypes maps export formats to their response content type
+var exportContentTypes = map[string]string{
+	secondaryfunctions.ExportCSV:   "text/csv",
+	secondaryfunctions.ExportJSONL: "application/x-ndjson",
+	secondaryfunctions.ExportXLSX:  "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// exportHandler returns the student report in the requested format, filtered
+// by date range, cohort and optionally to students active in the period
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = secondaryfunctions.ExportCSV
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		sendJSONError(w, "Unsupported export format", http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := secondaryfunctions.ExportFilter{
+		From:       from,
+		To:         to,
+		CourseID:   r.URL.Query().Get("course"),
+		ActiveOnly: r.URL.Query().Get("active") == "true",
+	}
+
+	// Build the report before sending headers so a database error can still be reported
+	var buf bytes.Buffer
+	writer, err := secondaryfunctions.NewExportWriter(&buf, format)
+	if err == nil {
+		err = secondaryfunctions.ExportStudents(filter, writer.Write)
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Admin %s: export failed | Error: %v", getClientIP(r), adminName(r), err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("students-%s-%s.%s", from.Format("20060102"), to.Add(-time.Nanosecond).Format("20060102"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", buf.Len()))
+	buf.WriteTo(w)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sathimantha/goqr/secondaryfunctions"
+)
+
+// batchOptions controls a generate-cert run over many students
+type batchOptions struct {
+	TemplateKey     string
+	Parallel        int    // number of certificates generated at once
+	ContinueOnError bool   // keep going after a failure instead of stopping the run
+	Checkpoint      string // file recording generated IDs so an interrupted run can resume
+}
+
+// batchFailure is a student whose certificate couldn't be generated
+type batchFailure struct {
+	StudentID string
+	Err       error
+}
+
+// readCheckpoint returns the IDs recorded in a checkpoint file. A missing file
+// is an empty checkpoint.
+func readCheckpoint(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening checkpoint: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			done[id] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading checkpoint: %v", err)
+	}
+	return done, nil
+}
+
+// runBatch generates certificates for ids with a pool of workers, showing
+// progress on standard error. IDs already in the checkpoint are skipped and
+// every generated ID is appended to it, so rerunning the same command after an
+// interruption carries on where it stopped. The checkpoint is removed once
+// every ID has been generated.
+func runBatch(ids []string, options batchOptions) error {
+	if options.Parallel < 1 {
+		options.Parallel = 1
+	}
+
+	var checkpoint *os.File
+	skipped := 0
+	if options.Checkpoint != "" {
+		done, err := readCheckpoint(options.Checkpoint)
+		if err != nil {
+			return err
+		}
+		pending := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if done[id] {
+				skipped++
+			} else {
+				pending = append(pending, id)
+			}
+		}
+		if skipped > 0 {
+			fmt.Printf("Resuming from %s: %d of %d certificates already generated\n", options.Checkpoint, skipped, len(ids))
+		}
+		ids = pending
+
+		checkpoint, err = os.OpenFile(options.Checkpoint, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening checkpoint: %v", err)
+		}
+		defer checkpoint.Close()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	progress := newProgressBar(os.Stderr, len(ids))
+	defer secondaryfunctions.SetLogOutput(progress)()
+
+	jobs := make(chan string)
+	go func() {
+		defer close(jobs)
+		for _, id := range ids {
+			select {
+			case jobs <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		mu        sync.Mutex
+		generated int
+		failures  []batchFailure
+		wg        sync.WaitGroup
+	)
+	for i := 0; i < options.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range jobs {
+				_, err := generateCertificateFor(id, options.TemplateKey)
+
+				mu.Lock()
+				if err != nil {
+					failures = append(failures, batchFailure{StudentID: id, Err: err})
+					if !options.ContinueOnError {
+						cancel()
+					}
+				} else {
+					generated++
+					if checkpoint != nil {
+						if _, err := fmt.Fprintln(checkpoint, id); err != nil {
+							log.Printf("Error writing checkpoint: %v", err)
+						}
+					}
+				}
+				mu.Unlock()
+				progress.Add(err == nil)
+			}
+		}()
+	}
+	wg.Wait()
+	progress.Finish()
+
+	interrupted := ctx.Err() != nil && (options.ContinueOnError || len(failures) == 0)
+	remaining := len(ids) - generated - len(failures)
+
+	fmt.Printf("Generated %d certificates, %d failed", generated, len(failures))
+	if skipped > 0 {
+		fmt.Printf(", %d skipped from checkpoint", skipped)
+	}
+	if remaining > 0 {
+		fmt.Printf(", %d not attempted", remaining)
+	}
+	fmt.Printf(" (%s)\n", progress.Elapsed().Round(time.Second))
+	for _, failure := range failures {
+		fmt.Printf("  %s: %v\n", failure.StudentID, failure.Err)
+	}
+
+	if checkpoint != nil {
+		if len(failures) == 0 && remaining == 0 {
+			checkpoint.Close()
+			if err := os.Remove(options.Checkpoint); err != nil {
+				log.Printf("Error removing checkpoint: %v", err)
+			}
+		} else {
+			fmt.Printf("Run the same command again to resume; progress is saved in %s\n", options.Checkpoint)
+		}
+	}
+
+	switch {
+	case interrupted:
+		return fmt.Errorf("interrupted")
+	case len(failures) > 0 && !options.ContinueOnError:
+		return fmt.Errorf("failed at ID %s: %v", failures[0].StudentID, failures[0].Err)
+	case len(failures) > 0:
+		return fmt.Errorf("%d of %d certificates failed", len(failures), len(ids))
+	}
+	return nil
+}
+
+// progressBar draws a progress line with an ETA. It is also used as the log
+// output during a run, so log lines appear above the bar instead of through
+// it. When the output isn't a terminal it prints a plain line every few
+// seconds instead of redrawing.
+type progressBar struct {
+	mu        sync.Mutex
+	out       io.Writer
+	terminal  bool
+	total     int
+	done      int
+	failed    int
+	started   time.Time
+	lastPrint time.Time
+}
+
+const progressBarWidth = 30
+
+func newProgressBar(out *os.File, total int) *progressBar {
+	terminal := false
+	if info, err := out.Stat(); err == nil {
+		terminal = info.Mode()&os.ModeCharDevice != 0
+	}
+	p := &progressBar{out: out, terminal: terminal, total: total, started: time.Now()}
+	p.mu.Lock()
+	p.draw()
+	p.mu.Unlock()
+	return p
+}
+
+// Add records one finished certificate
+func (p *progressBar) Add(ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if !ok {
+		p.failed++
+	}
+	if p.terminal || time.Since(p.lastPrint) >= 5*time.Second || p.done == p.total {
+		p.draw()
+	}
+}
+
+// Write prints a log line above the bar
+func (p *progressBar) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.terminal {
+		fmt.Fprint(p.out, "\r\033[K")
+	}
+	n, err := p.out.Write(b)
+	if p.terminal {
+		p.draw()
+	}
+	return n, err
+}
+
+// Finish ends the progress line
+func (p *progressBar) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.terminal {
+		fmt.Fprintln(p.out)
+	}
+}
+
+// Elapsed returns the time since the run started
+func (p *progressBar) Elapsed() time.Duration {
+	return time.Since(p.started)
+}
+
+func (p *progressBar) draw() {
+	p.lastPrint = time.Now()
+
+	percent := 100
+	if p.total > 0 {
+		percent = p.done * 100 / p.total
+	}
+	eta := "--"
+	if p.done > 0 && p.done < p.total {
+		remaining := time.Since(p.started) / time.Duration(p.done) * time.Duration(p.total-p.done)
+		eta = remaining.Round(time.Second).String()
+	} else if p.done == p.total {
+		eta = "0s"
+	}
+	status := fmt.Sprintf("%d/%d (%d%%), %d failed, ETA %s", p.done, p.total, percent, p.failed, eta)
+
+	if !p.terminal {
+		fmt.Fprintln(p.out, status)
+		return
+	}
+	filled := progressBarWidth * percent / 100
+	bar := strings.Repeat("#", filled) + strings.Repeat(".", progressBarWidth-filled)
+	fmt.Fprintf(p.out, "\r\033[K[%s] %s", bar, status)
+}
@@ -2,65 +2,278 @@
 package certificate
 
 import (
+	"bytes"
 	"fmt"
 	"image"
 	"image/draw"
 	"image/jpeg"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/jung-kurt/gofpdf"
 	"github.com/skip2/go-qrcode"
 )
 
+// DefaultTemplate is the template image used when none is given, relative to the assets directory
+const DefaultTemplate = "Certificate_Template.jpg"
+
+// DefaultBaseURL is the public address of the site when none is configured
+const DefaultBaseURL = "https://cpcglobal.org"
+
 // Generator handles certificate generation operations
 type Generator struct {
-	BaseDir   string
-	OutputDir string
-	FontPath  string // Add this field to hold the font path
+	BaseDir      string // assets directory that relative template and font paths are resolved against
+	OutputDir    string
+	BaseURL      string // public address of the site, for the QR code; DefaultBaseURL if empty
+	FontPath     string // Default font for fields that don't name one
+	TemplatePath string
+	Layout       *Layout
+	Keyring      *Keyring // Signs the QR code token; without it the QR carries the bare student ID
+
+	templateJPEG []byte // template image, read once so rendering never touches the disk
+}
+
+// Format is a certificate output format
+type Format string
+
+// Supported output formats
+const (
+	FormatPDF  Format = "pdf"
+	FormatJPEG Format = "jpeg"
+)
+
+// CertificateData holds the values drawn onto a certificate
+type CertificateData struct {
+	StudentName string
+	StudentID   string
+	Serial      string
+	IssuedAt    time.Time
+}
+
+// values maps the data onto layout field names
+func (d CertificateData) values() map[string]string {
+	values := map[string]string{
+		FieldStudentName: d.StudentName,
+		FieldStudentID:   d.StudentID,
+		FieldSerial:      d.Serial,
+	}
+	if !d.IssuedAt.IsZero() {
+		values[FieldIssueDate] = d.IssuedAt.Format("02/01/2006")
+	}
+	return values
+}
+
+// NewGenerator creates a new certificate generator for the default template
+func NewGenerator(assetsDir, outputDir, fontPath string) (*Generator, error) {
+	return NewTemplateGenerator(assetsDir, outputDir, fontPath, DefaultTemplate)
 }
 
-// NewGenerator creates a new certificate generator
-func NewGenerator(baseDir, outputDir, fontPath string) *Generator {
-	return &Generator{
-		BaseDir:   baseDir,
-		OutputDir: outputDir,
-		FontPath:  fontPath, // Initialize the font path
+// NewTemplateGenerator creates a certificate generator for the given template
+// image and loads the layout that sits next to it
+func NewTemplateGenerator(assetsDir, outputDir, fontPath, templatePath string) (*Generator, error) {
+	if !filepath.IsAbs(templatePath) {
+		templatePath = filepath.Join(assetsDir, templatePath)
+	}
+
+	g := &Generator{
+		BaseDir:      assetsDir,
+		OutputDir:    outputDir,
+		FontPath:     fontPath,
+		TemplatePath: templatePath,
+	}
+
+	layout, err := LoadLayout(LayoutPathFor(g.TemplatePath), g.TemplatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure every font the layout refers to can be parsed before we need it
+	for _, field := range layout.Fields {
+		for _, fontPath := range g.fieldFonts(field) {
+			if _, err := loadFont(fontPath); err != nil {
+				return nil, fmt.Errorf("font for field %q is not usable: %v", field.Name, err)
+			}
+		}
+	}
+
+	g.templateJPEG, err = os.ReadFile(templatePath)
+	if err != nil {
+		return nil, fmt.Errorf("template not found at %s: %v", templatePath, err)
+	}
+
+	g.Layout = layout
+	return g, nil
+}
+
+// fieldFonts resolves a layout field's font followed by its fallback fonts
+func (g *Generator) fieldFonts(field Field) []string {
+	fontPaths := append([]string{field.Font}, field.FallbackFonts...)
+	if fontPaths[0] == "" {
+		fontPaths[0] = g.FontPath
+	}
+	for i, fontPath := range fontPaths {
+		if !filepath.IsAbs(fontPath) {
+			fontPaths[i] = filepath.Join(g.BaseDir, fontPath)
+		}
+	}
+	return fontPaths
+}
+
+// fieldValue returns the text drawn into a field: its fixed wording or the matching value
+func fieldValue(field Field, values map[string]string) string {
+	if field.Text != "" {
+		return field.Text
+	}
+	return values[field.Name]
+}
+
+// verifyURL is the address encoded in a certificate's QR code. With a keyring
+// the fragment is a signed token, otherwise the bare student ID.
+func (g *Generator) verifyURL(data CertificateData) string {
+	baseURL := strings.TrimSuffix(g.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	if g.Keyring == nil {
+		return fmt.Sprintf("%s/verify#%s", baseURL, data.StudentID)
+	}
+	return fmt.Sprintf("%s/verify#%s", baseURL, g.Keyring.Sign(data))
+}
+
+// TempSuffix ends the names of PDFs that are still being written
+const TempSuffix = ".tmp"
+
+// GenerateCertificate renders a certificate PDF into the output directory and returns its path.
+// The PDF is written to a temporary file and renamed into place, so a reader
+// sees either the previous certificate or the complete new one.
+func (g *Generator) GenerateCertificate(data CertificateData) (string, error) {
+	staged, err := g.StageCertificate(data)
+	if err != nil {
+		return "", err
+	}
+	if err := staged.Commit(); err != nil {
+		staged.Discard()
+		return "", err
 	}
+	return staged.Path, nil
 }
 
-// GenerateCertificate creates a certificate image, overlays text and QR code, and converts it to PDF.
-func (g *Generator) GenerateCertificate(studentName, studentID string) (string, error) {
+// StagedCertificate is a rendered PDF waiting in a temporary file next to the
+// certificate it will replace
+type StagedCertificate struct {
+	Path     string // where Commit moves it
+	TempPath string
+}
+
+// StageCertificate renders a certificate PDF to a temporary file in the output
+// directory. The previous certificate stays in place until Commit.
+func (g *Generator) StageCertificate(data CertificateData) (*StagedCertificate, error) {
+	studentID := data.StudentID
+
 	// Create output directory if it doesn't exist
 	if err := os.MkdirAll(g.OutputDir, os.ModePerm); err != nil {
-		return "", fmt.Errorf("failed to create output directory: %v", err)
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
 	}
 
-	// Load and process template
-	templatePath := filepath.Join(g.BaseDir, "assets/Certificate_Template.jpg")
-	rgba, err := g.loadAndProcessTemplate(templatePath, studentName)
+	pdfPath := filepath.Join(g.OutputDir, fmt.Sprintf("%s.pdf", studentID))
+	file, err := os.CreateTemp(g.OutputDir, fmt.Sprintf("%s.*.pdf%s", studentID, TempSuffix))
 	if err != nil {
-		return "", fmt.Errorf("failed to process template: %v", err)
+		return nil, fmt.Errorf("failed to create PDF: %v", err)
 	}
+	tempPath := file.Name()
 
-	// Generate and overlay QR code
-	if err := g.addQRCode(rgba, studentID); err != nil {
-		return "", fmt.Errorf("failed to add QR code: %v", err)
+	if err := g.RenderTo(file, data, FormatPDF); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return nil, err
+	}
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return nil, fmt.Errorf("failed to set PDF permissions: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tempPath)
+		return nil, fmt.Errorf("failed to write PDF: %v", err)
+	}
+	return &StagedCertificate{Path: pdfPath, TempPath: tempPath}, nil
+}
+
+// Commit atomically replaces the certificate with the staged one
+func (s *StagedCertificate) Commit() error {
+	if err := os.Rename(s.TempPath, s.Path); err != nil {
+		return fmt.Errorf("failed to move PDF into place: %v", err)
 	}
+	log.Printf("Certificate generated successfully: %s\n", s.Path)
+	return nil
+}
 
-	// Save final certificate and convert to PDF
-	return g.saveAsPDF(rgba, studentID)
+// Discard deletes the staged file if it wasn't committed
+func (s *StagedCertificate) Discard() {
+	if err := os.Remove(s.TempPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error deleting staged certificate %s: %v\n", s.TempPath, err)
+	}
 }
 
-func (g *Generator) loadAndProcessTemplate(templatePath string, studentName string) (*image.RGBA, error) {
-	templateFile, err := os.Open(templatePath)
+// RenderTo renders a certificate entirely in memory and writes it to w.
+// PDFs use the layout's render mode; if vector rendering fails the raster
+// path is used as a fallback.
+func (g *Generator) RenderTo(w io.Writer, data CertificateData, format Format) error {
+	values := data.values()
+
+	switch format {
+	case FormatPDF:
+		if g.Layout.Render == RenderVector {
+			pdf, err := g.buildVectorPDF(values, data)
+			if err == nil {
+				return pdf.Output(w)
+			}
+			log.Printf("Vector rendering failed for student ID %s, falling back to raster: %v\n", data.StudentID, err)
+		}
+
+		rgba, err := g.renderImage(values, data)
+		if err != nil {
+			return err
+		}
+		return writeRasterPDF(w, rgba, data.IssuedAt)
+
+	case FormatJPEG:
+		rgba, err := g.renderImage(values, data)
+		if err != nil {
+			return err
+		}
+		if err := jpeg.Encode(w, rgba, nil); err != nil {
+			return fmt.Errorf("failed to encode JPEG: %v", err)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported certificate format: %s", format)
+	}
+}
+
+// renderImage draws the fields and QR code onto a copy of the template image
+func (g *Generator) renderImage(values map[string]string, data CertificateData) (*image.RGBA, error) {
+	// Load and process template
+	rgba, err := g.loadAndProcessTemplate(values)
 	if err != nil {
-		return nil, fmt.Errorf("template not found at %s: %v", templatePath, err)
+		return nil, fmt.Errorf("failed to process template: %v", err)
+	}
+
+	// Generate and overlay QR code
+	if err := g.addQRCode(rgba, g.verifyURL(data)); err != nil {
+		return nil, fmt.Errorf("failed to add QR code: %v", err)
 	}
-	defer templateFile.Close()
 
-	certificateTemplateImage, err := jpeg.Decode(templateFile)
+	return rgba, nil
+}
+
+func (g *Generator) loadAndProcessTemplate(values map[string]string) (*image.RGBA, error) {
+	certificateTemplateImage, err := jpeg.Decode(bytes.NewReader(g.templateJPEG))
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode template: %v", err)
 	}
@@ -69,54 +282,56 @@ func (g *Generator) loadAndProcessTemplate(templatePath string, studentName stri
 	rgba := image.NewRGBA(certificateTemplateImage.Bounds())
 	draw.Draw(rgba, rgba.Bounds(), certificateTemplateImage, image.Point{}, draw.Src)
 
-	// Add student name
-	imgWidth := certificateTemplateImage.Bounds().Dx()
-	fontScale := 150.0 //Max font size
-
+	// Draw each field the layout defines
 	textRenderer := NewTextRenderer(rgba)
-	// Pass the fontPath from the Generator struct to AddText
-	textRenderer.AddText(studentName, imgWidth, 3000, fontScale, g.FontPath)
+	for _, field := range g.Layout.Fields {
+		text := fieldValue(field, values)
+		if text == "" {
+			continue
+		}
+		if err := textRenderer.AddText(text, field, g.fieldFonts(field)); err != nil {
+			return nil, fmt.Errorf("failed to draw field %q: %v", field.Name, err)
+		}
+	}
 
 	return rgba, nil
 }
 
-func (g *Generator) addQRCode(rgba *image.RGBA, studentID string) error {
-	url := fmt.Sprintf("https://cpcglobal.org/verify#%s", studentID)
-	qrPath := filepath.Join(g.OutputDir, fmt.Sprintf("%s_qr.png", studentID))
-
+func (g *Generator) addQRCode(rgba *image.RGBA, url string) error {
 	// Generate QR code
-	if err := qrcode.WriteFile(url, qrcode.Medium, 600, qrPath); err != nil {
-		return fmt.Errorf("failed to generate QR code: %v", err)
-	}
-	defer os.Remove(qrPath)
-
-	// Load and overlay QR code
-	qr, err := LoadQRCode(qrPath)
+	box := g.Layout.QR
+	qr, err := qrcode.New(url, qrcode.Medium)
 	if err != nil {
-		return fmt.Errorf("failed to load QR code: %v", err)
+		return fmt.Errorf("failed to generate QR code: %v", err)
 	}
+	qrImage := qr.Image(box.Size)
 
-	imgWidth := rgba.Bounds().Dx()
-	offset := image.Pt(imgWidth-qr.Bounds().Dx()-90, 90)
-	draw.Draw(rgba, qr.Bounds().Add(offset), qr, image.Point{}, draw.Over)
+	offset := image.Pt(box.X, box.Y)
+	draw.Draw(rgba, qrImage.Bounds().Add(offset), qrImage, image.Point{}, draw.Over)
 
 	return nil
 }
 
-// saveAsPDF saves the final certificate as a PDF file.
-func (g *Generator) saveAsPDF(rgba *image.RGBA, studentID string) (string, error) {
-	// Save intermediate JPEG
-	tempJPEGPath := filepath.Join(g.OutputDir, fmt.Sprintf("%s_final.jpg", studentID))
-	if err := SaveAsJPEG(rgba, tempJPEGPath); err != nil {
-		return "", fmt.Errorf("failed to save temporary JPEG: %v", err)
+// newPDF creates an A4 document dated with the issue date, so re-rendering the
+// same certificate produces the same bytes
+func newPDF(issuedAt time.Time) *gofpdf.Fpdf {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	if !issuedAt.IsZero() {
+		pdf.SetCreationDate(issuedAt)
+		pdf.SetModificationDate(issuedAt)
 	}
-	defer os.Remove(tempJPEGPath)
+	return pdf
+}
 
-	// Convert to PDF with zero margins
-	pdfPath := filepath.Join(g.OutputDir, fmt.Sprintf("%s.pdf", studentID))
+// writeRasterPDF embeds the finished certificate image as a single full-page JPEG.
+func writeRasterPDF(w io.Writer, rgba *image.RGBA, issuedAt time.Time) error {
+	var jpegData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, rgba, nil); err != nil {
+		return fmt.Errorf("failed to encode certificate image: %v", err)
+	}
 
 	// Create new PDF with zero margins
-	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf := newPDF(issuedAt)
 
 	// Set margins to 0 (left, top, right)
 	pdf.SetMargins(0, 0, 0)
@@ -131,12 +346,12 @@ func (g *Generator) saveAsPDF(rgba *image.RGBA, studentID string) (string, error
 	pageWidth, pageHeight := pdf.GetPageSize()
 
 	// Place image to cover entire page
-	pdf.Image(tempJPEGPath, 0, 0, pageWidth, pageHeight, false, "", 0, "")
+	options := gofpdf.ImageOptions{ImageType: "JPG"}
+	pdf.RegisterImageOptionsReader("certificate", options, &jpegData)
+	pdf.ImageOptions("certificate", 0, 0, pageWidth, pageHeight, false, options, 0, "")
 
-	if err := pdf.OutputFileAndClose(pdfPath); err != nil {
-		return "", fmt.Errorf("failed to create PDF: %v", err)
+	if err := pdf.Output(w); err != nil {
+		return fmt.Errorf("failed to create PDF: %v", err)
 	}
-
-	log.Printf("Certificate generated successfully for student ID: %s\n", studentID)
-	return pdfPath, nil
+	return nil
 }
@@ -0,0 +1,203 @@
+// certificate/layout.go
+package certificate
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Names of the fields a layout can place on a certificate
+const (
+	FieldStudentName = "student_name"
+	FieldStudentID   = "student_id"
+	FieldSerial      = "serial"
+	FieldIssueDate   = "issue_date" // formatted DD/MM/YYYY
+)
+
+// knownFields lists every field name a layout is allowed to reference
+var knownFields = map[string]bool{
+	FieldStudentName: true,
+	FieldStudentID:   true,
+	FieldSerial:      true,
+	FieldIssueDate:   true,
+}
+
+// Text alignments relative to a field's X coordinate
+const (
+	AlignLeft   = "left"
+	AlignCenter = "center"
+	AlignRight  = "right"
+)
+
+// Render modes for the PDF output
+const (
+	RenderVector = "vector" // template as background, real text and vector QR code
+	RenderRaster = "raster" // everything flattened into a single JPEG page
+)
+
+// Layout describes where content is placed on a certificate template.
+// It is stored as JSON next to the template image, e.g.
+// Certificate_Template.jpg -> Certificate_Template.json in the assets directory
+type Layout struct {
+	Render string  `json:"render,omitempty"` // RenderVector (default) or RenderRaster
+	Fields []Field `json:"fields"`
+	QR     QRBox   `json:"qr"`
+
+	// Template image size in pixels, filled in by LoadLayout
+	Width  int `json:"-"`
+	Height int `json:"-"`
+}
+
+// Field is a named block of text drawn onto the template.
+// X is the anchor for the alignment and Y is the text baseline, both in pixels.
+// A field with Text set always draws that fixed wording; otherwise the value is
+// looked up by Name from the certificate data. Characters missing from Font are
+// drawn with the first of FallbackFonts that has them.
+type Field struct {
+	Name          string   `json:"name"`
+	Text          string   `json:"text,omitempty"`
+	X             int      `json:"x"`
+	Y             int      `json:"y"`
+	Align         string   `json:"align"`
+	MaxWidth      int      `json:"max_width"`
+	Font          string   `json:"font"`
+	FallbackFonts []string `json:"fallback_fonts,omitempty"`
+	MinSize       float64  `json:"min_size"`
+	MaxSize       float64  `json:"max_size"`
+	Color         string   `json:"color"`
+}
+
+// QRBox is the square area, in pixels, the verification QR code is drawn into
+type QRBox struct {
+	X    int `json:"x"`
+	Y    int `json:"y"`
+	Size int `json:"size"`
+}
+
+// LayoutPathFor returns the layout file path that belongs to a template image
+func LayoutPathFor(templatePath string) string {
+	return strings.TrimSuffix(templatePath, filepath.Ext(templatePath)) + ".json"
+}
+
+// LoadLayout reads a layout file and validates it against the template image
+func LoadLayout(layoutPath, templatePath string) (*Layout, error) {
+	data, err := os.ReadFile(layoutPath)
+	if err != nil {
+		return nil, fmt.Errorf("layout not found at %s: %v", layoutPath, err)
+	}
+
+	var layout Layout
+	if err := json.Unmarshal(data, &layout); err != nil {
+		return nil, fmt.Errorf("failed to parse layout %s: %v", layoutPath, err)
+	}
+
+	templateFile, err := os.Open(templatePath)
+	if err != nil {
+		return nil, fmt.Errorf("template not found at %s: %v", templatePath, err)
+	}
+	defer templateFile.Close()
+
+	config, _, err := image.DecodeConfig(templateFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template dimensions: %v", err)
+	}
+
+	if err := layout.Validate(image.Rect(0, 0, config.Width, config.Height)); err != nil {
+		return nil, fmt.Errorf("invalid layout %s: %v", layoutPath, err)
+	}
+
+	if layout.Render == "" {
+		layout.Render = RenderVector
+	}
+	layout.Width, layout.Height = config.Width, config.Height
+
+	return &layout, nil
+}
+
+// Validate checks that every field and the QR box fit inside the image bounds
+func (l *Layout) Validate(bounds image.Rectangle) error {
+	switch l.Render {
+	case "", RenderVector, RenderRaster:
+	default:
+		return fmt.Errorf("unknown render mode %q", l.Render)
+	}
+
+	seen := make(map[string]bool)
+	for _, f := range l.Fields {
+		if f.Name == "" {
+			return fmt.Errorf("field without a name")
+		}
+		if f.Text == "" && !knownFields[f.Name] {
+			return fmt.Errorf("unknown field %q", f.Name)
+		}
+		if seen[f.Name] {
+			return fmt.Errorf("field %q is defined more than once", f.Name)
+		}
+		seen[f.Name] = true
+
+		if f.MaxSize <= 0 {
+			return fmt.Errorf("field %q: max_size must be positive", f.Name)
+		}
+		if f.MinSize < 0 || f.MinSize > f.MaxSize {
+			return fmt.Errorf("field %q: min_size must be between 0 and max_size", f.Name)
+		}
+		if f.MaxWidth <= 0 {
+			return fmt.Errorf("field %q: max_width must be positive", f.Name)
+		}
+		if _, err := parseColor(f.Color); err != nil {
+			return fmt.Errorf("field %q: %v", f.Name, err)
+		}
+
+		var left int
+		switch f.Align {
+		case AlignLeft:
+			left = f.X
+		case AlignCenter:
+			left = f.X - f.MaxWidth/2
+		case AlignRight:
+			left = f.X - f.MaxWidth
+		default:
+			return fmt.Errorf("field %q: unknown alignment %q", f.Name, f.Align)
+		}
+
+		box := image.Rect(left, f.Y-int(f.MaxSize), left+f.MaxWidth, f.Y)
+		if !box.In(bounds) {
+			return fmt.Errorf("field %q at %v falls outside the template bounds %v", f.Name, box, bounds)
+		}
+	}
+
+	if l.QR.Size <= 0 {
+		return fmt.Errorf("qr: size must be positive")
+	}
+	qrBox := image.Rect(l.QR.X, l.QR.Y, l.QR.X+l.QR.Size, l.QR.Y+l.QR.Size)
+	if !qrBox.In(bounds) {
+		return fmt.Errorf("qr box %v falls outside the template bounds %v", qrBox, bounds)
+	}
+
+	return nil
+}
+
+// parseColor parses a #RRGGBB or #RRGGBBAA hex color
+func parseColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 && len(hex) != 8 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q, expected #RRGGBB or #RRGGBBAA", s)
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q: %v", s, err)
+	}
+
+	return color.RGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
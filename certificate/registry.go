@@ -0,0 +1,132 @@
+// certificate/registry.go
+package certificate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// RegistryFile is the template registry location, relative to the assets directory
+const RegistryFile = "templates.json"
+
+// DefaultTemplateKey is the key used when the registry file doesn't name a default
+const DefaultTemplateKey = "default"
+
+// registryFile is the on-disk format of the template registry
+type registryFile struct {
+	Default   string            `json:"default"`
+	Templates map[string]string `json:"templates"` // key -> template image path
+}
+
+// Registry holds a generator for every certificate template, keyed by template key
+type Registry struct {
+	DefaultKey string
+	generators map[string]*Generator
+}
+
+// LoadRegistry reads the template registry and loads every template's layout
+// up front, so a broken template is reported at startup rather than on first use.
+// Without a registry file only the default template is available. Relative
+// paths in the registry and layouts are resolved against assetsDir.
+func LoadRegistry(assetsDir, outputDir, fontPath string) (*Registry, error) {
+	file := registryFile{
+		Default:   DefaultTemplateKey,
+		Templates: map[string]string{DefaultTemplateKey: DefaultTemplate},
+	}
+
+	registryPath := filepath.Join(assetsDir, RegistryFile)
+	data, err := os.ReadFile(registryPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read template registry %s: %v", registryPath, err)
+	}
+	if err == nil {
+		file = registryFile{}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("failed to parse template registry %s: %v", registryPath, err)
+		}
+		if file.Default == "" {
+			file.Default = DefaultTemplateKey
+		}
+	}
+
+	if _, ok := file.Templates[file.Default]; !ok {
+		return nil, fmt.Errorf("default template %q is not defined in the registry", file.Default)
+	}
+
+	r := &Registry{
+		DefaultKey: file.Default,
+		generators: make(map[string]*Generator),
+	}
+	for key, templatePath := range file.Templates {
+		g, err := NewTemplateGenerator(assetsDir, outputDir, fontPath, templatePath)
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %v", key, err)
+		}
+		r.generators[key] = g
+	}
+
+	return r, nil
+}
+
+// Generator returns the generator for a template key; an empty key selects the default template
+func (r *Registry) Generator(key string) (*Generator, error) {
+	if key == "" {
+		key = r.DefaultKey
+	}
+	g, ok := r.generators[key]
+	if !ok {
+		return nil, fmt.Errorf("unknown certificate template: %s", key)
+	}
+	return g, nil
+}
+
+// SetKeyring makes every template sign its QR codes with the given keyring
+func (r *Registry) SetKeyring(k *Keyring) {
+	for _, g := range r.generators {
+		g.Keyring = k
+	}
+}
+
+// SetBaseURL sets the public site address every template encodes in its QR codes
+func (r *Registry) SetBaseURL(baseURL string) {
+	for _, g := range r.generators {
+		g.BaseURL = baseURL
+	}
+}
+
+// CheckFiles verifies that every template image and font can still be read
+func (r *Registry) CheckFiles() error {
+	for key, g := range r.generators {
+		files := []string{g.TemplatePath}
+		for _, field := range g.Layout.Fields {
+			files = append(files, g.fieldFonts(field)...)
+		}
+		for _, path := range files {
+			file, err := os.Open(path)
+			if err != nil {
+				return fmt.Errorf("template %q: %v", key, err)
+			}
+			file.Close()
+		}
+	}
+	return nil
+}
+
+// Has reports whether a template key is registered
+func (r *Registry) Has(key string) bool {
+	_, ok := r.generators[key]
+	return ok
+}
+
+// Keys returns the registered template keys in sorted order
+func (r *Registry) Keys() []string {
+	keys := make([]string, 0, len(r.generators))
+	for key := range r.generators {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,236 @@
+// certificate/shaping.go
+package certificate
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/go-text/typesetting/di"
+	"github.com/go-text/typesetting/font"
+	ot "github.com/go-text/typesetting/font/opentype"
+	"github.com/go-text/typesetting/language"
+	"github.com/go-text/typesetting/shaping"
+	"golang.org/x/image/math/fixed"
+)
+
+// fontCache keeps parsed fonts by path; a font is read-only and can be shared,
+// while the faces built from it carry caches and are created per shaping call
+var fontCache = struct {
+	sync.Mutex
+	fonts map[string]*font.Font
+}{
+	fonts: make(map[string]*font.Font),
+}
+
+// loadFont parses a TrueType/OpenType font file once and caches it
+func loadFont(fontPath string) (*font.Font, error) {
+	fontCache.Lock()
+	defer fontCache.Unlock()
+
+	if f, ok := fontCache.fonts[fontPath]; ok {
+		return f, nil
+	}
+
+	fontBytes, err := os.ReadFile(fontPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read font file: %v", err)
+	}
+	face, err := font.ParseTTF(bytes.NewReader(fontBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse font %s: %v", fontPath, err)
+	}
+
+	fontCache.fonts[fontPath] = face.Font
+	return face.Font, nil
+}
+
+// fontChain is a field's fonts in fallback order. Each rune is drawn with the
+// first font that has a glyph for it, or the primary font if none does.
+type fontChain struct {
+	faces []*font.Face
+	paths []string
+}
+
+func newFontChain(fontPaths []string) (*fontChain, error) {
+	chain := &fontChain{paths: fontPaths}
+	for _, fontPath := range fontPaths {
+		f, err := loadFont(fontPath)
+		if err != nil {
+			return nil, err
+		}
+		chain.faces = append(chain.faces, font.NewFace(f))
+	}
+	return chain, nil
+}
+
+// ResolveFace implements shaping.Fontmap
+func (c *fontChain) ResolveFace(r rune) *font.Face {
+	for _, face := range c.faces {
+		if _, ok := face.NominalGlyph(r); ok {
+			return face
+		}
+	}
+	return c.faces[0]
+}
+
+// pathOf returns the font file a face in the chain was loaded from
+func (c *fontChain) pathOf(face *font.Face) string {
+	for i, f := range c.faces {
+		if f == face {
+			return c.paths[i]
+		}
+	}
+	return c.paths[0]
+}
+
+// shapedText is a single line of text shaped with OpenType GSUB/GPOS,
+// split into runs that share a script and a font
+type shapedText struct {
+	text  []rune
+	runs  []shaping.Output
+	chain *fontChain
+	size  float64
+}
+
+// shapeText shapes text at the given size (in output units per em).
+// Names are laid out left to right; right-to-left scripts are not supported.
+func shapeText(text string, chain *fontChain, size float64) *shapedText {
+	runes := []rune(text)
+	input := shaping.Input{
+		Text:      runes,
+		RunStart:  0,
+		RunEnd:    len(runes),
+		Direction: di.DirectionLTR,
+		Size:      fixed.Int26_6(size * 64),
+		Language:  language.DefaultLanguage(),
+	}
+
+	var segmenter shaping.Segmenter
+	var shaper shaping.HarfbuzzShaper
+	shaped := &shapedText{text: runes, chain: chain, size: size}
+	for _, run := range segmenter.Split(input, chain) {
+		shaped.runs = append(shaped.runs, shaper.Shape(run))
+	}
+	return shaped
+}
+
+// width returns the advance of the whole line
+func (s *shapedText) width() float64 {
+	var advance fixed.Int26_6
+	for _, run := range s.runs {
+		advance += run.Advance
+	}
+	return float64(advance) / 64
+}
+
+// isSimple reports whether the line is plain text in the primary font: one glyph
+// per rune, each the font's nominal glyph and without positioning adjustments.
+// Such text can be handed to a PDF text operator without losing anything.
+func (s *shapedText) isSimple() bool {
+	primary := s.chain.faces[0]
+	for _, run := range s.runs {
+		if run.Face != primary {
+			return false
+		}
+		for _, g := range run.Glyphs {
+			if g.RuneCount != 1 || g.GlyphCount != 1 || g.XOffset != 0 || g.YOffset != 0 {
+				return false
+			}
+			if gid, ok := primary.NominalGlyph(s.text[g.ClusterIndex]); !ok || gid != g.GlyphID {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// glyphPath receives glyph outlines in output coordinates, with Y growing down
+type glyphPath interface {
+	MoveTo(x, y float64)
+	LineTo(x, y float64)
+	QuadTo(cx, cy, x, y float64)
+	CubeTo(cx0, cy0, cx1, cy1, x, y float64)
+	ClosePath()
+}
+
+// outline emits every glyph of the line to p, starting at the given baseline origin.
+// scale converts shaped units into output units.
+func (s *shapedText) outline(p glyphPath, x, y, scale float64) {
+	dot := x
+	for _, run := range s.runs {
+		// Font units to shaped units
+		unit := s.size / float64(run.Face.Upem()) * scale
+		for _, g := range run.Glyphs {
+			gx := dot + float64(g.XOffset)/64*scale
+			gy := y - float64(g.YOffset)/64*scale
+			dot += float64(g.Advance) / 64 * scale
+
+			glyph, ok := run.Face.GlyphDataOutline(g.GlyphID)
+			if !ok {
+				continue
+			}
+
+			pt := func(sp ot.SegmentPoint) (float64, float64) {
+				return gx + float64(sp.X)*unit, gy - float64(sp.Y)*unit
+			}
+			started := false
+			for _, seg := range glyph.Segments {
+				switch seg.Op {
+				case ot.SegmentOpMoveTo:
+					if started {
+						p.ClosePath()
+					}
+					started = true
+					p.MoveTo(pt(seg.Args[0]))
+				case ot.SegmentOpLineTo:
+					p.LineTo(pt(seg.Args[0]))
+				case ot.SegmentOpQuadTo:
+					cx, cy := pt(seg.Args[0])
+					ex, ey := pt(seg.Args[1])
+					p.QuadTo(cx, cy, ex, ey)
+				case ot.SegmentOpCubeTo:
+					c0x, c0y := pt(seg.Args[0])
+					c1x, c1y := pt(seg.Args[1])
+					ex, ey := pt(seg.Args[2])
+					p.CubeTo(c0x, c0y, c1x, c1y, ex, ey)
+				}
+			}
+			if started {
+				p.ClosePath()
+			}
+		}
+	}
+}
+
+// runText returns the part of the text a run was shaped from
+func (s *shapedText) runText(run shaping.Output) string {
+	return string(s.text[run.Runes.Offset : run.Runes.Offset+run.Runes.Count])
+}
+
+// fitText shapes text at the field's max size and shrinks it, but not below
+// the min size, until it fits the field's max width. Sizes are in template pixels.
+func fitText(text string, chain *fontChain, field Field) *shapedText {
+	shaped := shapeText(text, chain, field.MaxSize)
+	if width := shaped.width(); width > float64(field.MaxWidth) {
+		size := field.MaxSize * float64(field.MaxWidth) / width
+		if size < field.MinSize {
+			size = field.MinSize
+		}
+		shaped = shapeText(text, chain, size)
+	}
+	return shaped
+}
+
+// alignX returns where a line of the given width starts for the field's alignment
+func alignX(field Field, width float64) float64 {
+	x := float64(field.X)
+	switch field.Align {
+	case AlignCenter:
+		x -= width / 2
+	case AlignRight:
+		x -= width
+	}
+	return x
+}
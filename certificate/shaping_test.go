@@ -0,0 +1,177 @@
+package certificate
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// The name field's chain in assets/Certificate_Template.json: Roboto has no
+// Sinhala or Tamil glyphs, FreeSerif has both
+var (
+	robotoFont    = filepath.Join("..", "assets", "Roboto-Regular.ttf")
+	freeSerifFont = filepath.Join("..", "assets", "FreeSerif.ttf")
+)
+
+func testChain(t *testing.T, paths ...string) *fontChain {
+	t.Helper()
+	chain, err := newFontChain(paths)
+	if err != nil {
+		t.Fatalf("newFontChain(%v): %v", paths, err)
+	}
+	return chain
+}
+
+// dumpShaped writes the runs and glyphs of a shaped line, one per line, in a
+// form that is stable and readable in a diff
+func dumpShaped(s *shapedText) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "text %q size %g width %g\n", string(s.text), s.size, s.width())
+	for _, run := range s.runs {
+		fmt.Fprintf(&b, "run %s %q\n", filepath.Base(s.chain.pathOf(run.Face)), s.runText(run))
+		for _, g := range run.Glyphs {
+			fmt.Fprintf(&b, "  glyph %d cluster %d advance %g offset %g,%g\n",
+				g.GlyphID, g.ClusterIndex, float64(g.Advance)/64, float64(g.XOffset)/64, float64(g.YOffset)/64)
+		}
+	}
+	return b.String()
+}
+
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", "shaping", name+".golden")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading golden file (run with -update to create it): %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("shaping of %s differs from %s:\ngot:\n%s\nwant:\n%s", name, path, got, want)
+	}
+}
+
+// noNotdef fails if any glyph is .notdef, which is drawn as a tofu box
+func noNotdef(t *testing.T, s *shapedText) {
+	t.Helper()
+	for _, run := range s.runs {
+		for _, g := range run.Glyphs {
+			if g.GlyphID == 0 {
+				t.Errorf("%q: rune %q shaped to .notdef", string(s.text), s.text[g.ClusterIndex])
+			}
+		}
+	}
+}
+
+func TestShapeTextGolden(t *testing.T) {
+	chain := testChain(t, robotoFont, freeSerifFont)
+	tests := []struct {
+		name string
+		text string
+	}{
+		// ශ්‍රී: sha, virama, ZWJ, ra, ii form a single conjunct
+		{"sinhala_conjunct", "ශ්‍රී"},
+		{"sinhala_name", "ප්‍රනාන්දු"},
+		{"tamil_name", "கிருஷ்ணன்"},
+		{"latin_sinhala_name", "Nimal ප්‍රනාන්දු"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shaped := shapeText(tt.text, chain, 48)
+			noNotdef(t, shaped)
+			checkGolden(t, tt.name, dumpShaped(shaped))
+		})
+	}
+}
+
+func TestShapeTextConjunct(t *testing.T) {
+	shaped := shapeText("ශ්‍රී", testChain(t, freeSerifFont), 48)
+	glyphs := 0
+	for _, run := range shaped.runs {
+		glyphs += len(run.Glyphs)
+	}
+	if runes := len(shaped.text); glyphs >= runes {
+		t.Errorf("conjunct shaped to %d glyphs from %d runes, want it ligated", glyphs, runes)
+	}
+	if shaped.isSimple() {
+		t.Error("shaped conjunct reported as simple text")
+	}
+}
+
+// A script the primary font lacks is shaped with the fallback font, exactly as
+// if that font were the primary
+func TestShapeTextFallback(t *testing.T) {
+	chain := testChain(t, robotoFont, freeSerifFont)
+	alone := testChain(t, freeSerifFont)
+	for _, text := range []string{"ශ්‍රී", "கிருஷ்ணன்"} {
+		shaped := shapeText(text, chain, 48)
+		noNotdef(t, shaped)
+		for _, run := range shaped.runs {
+			if path := chain.pathOf(run.Face); path != freeSerifFont {
+				t.Errorf("%q: run %q shaped with %s, want %s", text, shaped.runText(run), path, freeSerifFont)
+			}
+		}
+		want := shapeText(text, alone, 48)
+		if got, want := dumpShaped(shaped), dumpShaped(want); got != want {
+			t.Errorf("%q: fallback shaping differs from the font alone:\ngot:\n%s\nwant:\n%s", text, got, want)
+		}
+	}
+
+	// The Latin part stays in the primary font
+	shaped := shapeText("Nimal ප්‍රනාන්දු", chain, 48)
+	if len(shaped.runs) != 2 {
+		t.Fatalf("got %d runs, want Latin and Sinhala", len(shaped.runs))
+	}
+	if path := chain.pathOf(shaped.runs[0].Face); path != robotoFont {
+		t.Errorf("Latin run shaped with %s, want %s", path, robotoFont)
+	}
+	if path := chain.pathOf(shaped.runs[1].Face); path != freeSerifFont {
+		t.Errorf("Sinhala run shaped with %s, want %s", path, freeSerifFont)
+	}
+
+	if !shapeText("Nimal Perera", chain, 48).isSimple() {
+		t.Error("plain Latin text in the primary font not reported as simple")
+	}
+}
+
+func TestFitText(t *testing.T) {
+	chain := testChain(t, robotoFont, freeSerifFont)
+	text := "Nimal ප්‍රනාන්දු"
+	natural := shapeText(text, chain, 48).width()
+
+	tests := []struct {
+		name     string
+		maxWidth int
+		minSize  float64
+		wantSize float64
+		fits     bool
+	}{
+		{"fits", int(natural) + 10, 12, 48, true},
+		{"shrinks", int(natural / 2), 12, 48 * float64(int(natural/2)) / natural, true},
+		{"stops at min size", int(natural / 10), 12, 12, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field := Field{MaxWidth: tt.maxWidth, MinSize: tt.minSize, MaxSize: 48}
+			shaped := fitText(text, chain, field)
+			if diff := shaped.size - tt.wantSize; diff > 0.01 || diff < -0.01 {
+				t.Errorf("size = %g, want %g", shaped.size, tt.wantSize)
+			}
+			if tt.fits && shaped.width() > float64(tt.maxWidth)+1 {
+				t.Errorf("width %g exceeds max width %d", shaped.width(), tt.maxWidth)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+// certificate/token.go
+package certificate
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A verification token is carried in the certificate's QR code as
+//
+//	<kid>.<payload>.<signature>
+//
+// where payload is base64url("<student_id>|<name_hash>|<YYYYMMDD>|<serial>"),
+// name_hash is base64url of the first 16 bytes of SHA-256 over the normalised
+// name, and signature is base64url of an Ed25519 signature over "<kid>.<payload>".
+// Anyone holding the public key for kid can check a scanned certificate offline.
+
+const tokenDateFormat = "20060102"
+
+// nameHashSize is how much of the SHA-256 name digest goes into a token
+const nameHashSize = 16
+
+var b64 = base64.RawURLEncoding
+
+// Token is the signed content of a certificate QR code
+type Token struct {
+	KeyID     string
+	StudentID string
+	NameHash  string
+	IssuedAt  time.Time
+	Serial    string
+}
+
+// NameHash returns the token name hash for a student name. Case and spacing
+// are normalised so the printed name can be checked against the token.
+func NameHash(name string) string {
+	normalised := strings.ToLower(strings.Join(strings.Fields(name), " "))
+	sum := sha256.Sum256([]byte(normalised))
+	return b64.EncodeToString(sum[:nameHashSize])
+}
+
+// MatchesName reports whether the token was issued for the given name
+func (t *Token) MatchesName(name string) bool {
+	return subtle.ConstantTimeCompare([]byte(t.NameHash), []byte(NameHash(name))) == 1
+}
+
+func (t *Token) payload() string {
+	return strings.Join([]string{t.StudentID, t.NameHash, t.IssuedAt.Format(tokenDateFormat), t.Serial}, "|")
+}
+
+// Keyring holds the key used to sign new certificates and the public keys of
+// every key still accepted for verification, identified by key ID
+type Keyring struct {
+	ActiveKeyID string
+	signingKey  ed25519.PrivateKey
+	publicKeys  map[string]ed25519.PublicKey
+}
+
+// LoadKeyring reads signing keys from a directory. <kid>.pem holds a PKCS#8
+// private key; <kid>.pub.pem holds the PKIX public key of a retired key that
+// is only used for verification. The private key for activeKeyID must exist.
+func LoadKeyring(dir, activeKeyID string) (*Keyring, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key directory %s: %v", dir, err)
+	}
+
+	k := &Keyring{
+		ActiveKeyID: activeKeyID,
+		publicKeys:  make(map[string]ed25519.PublicKey),
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".pem") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key %s: %v", name, err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("key %s is not PEM encoded", name)
+		}
+
+		if kid := strings.TrimSuffix(name, ".pub.pem"); kid != name {
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse public key %s: %v", name, err)
+			}
+			publicKey, ok := key.(ed25519.PublicKey)
+			if !ok {
+				return nil, fmt.Errorf("public key %s is not an Ed25519 key", name)
+			}
+			if _, exists := k.publicKeys[kid]; !exists {
+				k.publicKeys[kid] = publicKey
+			}
+			continue
+		}
+
+		kid := strings.TrimSuffix(name, ".pem")
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key %s: %v", name, err)
+		}
+		privateKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key %s is not an Ed25519 key", name)
+		}
+		k.publicKeys[kid] = privateKey.Public().(ed25519.PublicKey)
+		if kid == activeKeyID {
+			k.signingKey = privateKey
+		}
+	}
+
+	if k.signingKey == nil {
+		return nil, fmt.Errorf("private key for active key ID %q not found in %s", activeKeyID, dir)
+	}
+
+	return k, nil
+}
+
+// GenerateKey writes a new Ed25519 key pair as <kid>.pem and <kid>.pub.pem in dir
+func GenerateKey(dir, kid string) error {
+	if kid == "" || strings.ContainsAny(kid, "./|") {
+		return fmt.Errorf("invalid key ID: %q", kid)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %v", err)
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %v", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode public key: %v", err)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create key directory: %v", err)
+	}
+
+	privatePath := filepath.Join(dir, kid+".pem")
+	privateFile, err := os.OpenFile(privatePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", privatePath, err)
+	}
+	defer privateFile.Close()
+	if err := pem.Encode(privateFile, &pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}); err != nil {
+		return fmt.Errorf("failed to write %s: %v", privatePath, err)
+	}
+
+	publicPath := filepath.Join(dir, kid+".pub.pem")
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+	if err := os.WriteFile(publicPath, publicPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", publicPath, err)
+	}
+
+	return nil
+}
+
+// Sign creates a token for a certificate with the active key
+func (k *Keyring) Sign(data CertificateData) string {
+	issuedAt := data.IssuedAt
+	if issuedAt.IsZero() {
+		issuedAt = time.Now()
+	}
+
+	t := Token{
+		KeyID:     k.ActiveKeyID,
+		StudentID: data.StudentID,
+		NameHash:  NameHash(data.StudentName),
+		IssuedAt:  issuedAt,
+		Serial:    data.Serial,
+	}
+
+	signed := t.KeyID + "." + b64.EncodeToString([]byte(t.payload()))
+	signature := ed25519.Sign(k.signingKey, []byte(signed))
+	return signed + "." + b64.EncodeToString(signature)
+}
+
+// Verify checks a token's signature against the key it names and returns its content
+func (k *Keyring) Verify(token string) (*Token, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	kid, encodedPayload, encodedSignature := parts[0], parts[1], parts[2]
+
+	publicKey, ok := k.publicKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID: %s", kid)
+	}
+
+	signature, err := b64.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+	if !ed25519.Verify(publicKey, []byte(kid+"."+encodedPayload), signature) {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	payload, err := b64.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload")
+	}
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("malformed token payload")
+	}
+	issuedAt, err := time.Parse(tokenDateFormat, fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token issue date")
+	}
+
+	return &Token{
+		KeyID:     kid,
+		StudentID: fields[0],
+		NameHash:  fields[1],
+		IssuedAt:  issuedAt,
+		Serial:    fields[3],
+	}, nil
+}
+
+// PublicKeys returns every verification key, base64url encoded, by key ID
+func (k *Keyring) PublicKeys() map[string]string {
+	keys := make(map[string]string, len(k.publicKeys))
+	for kid, publicKey := range k.publicKeys {
+		keys[kid] = b64.EncodeToString(publicKey)
+	}
+	return keys
+}
+
+// KeyIDs returns the key IDs accepted for verification in sorted order
+func (k *Keyring) KeyIDs() []string {
+	kids := make([]string, 0, len(k.publicKeys))
+	for kid := range k.publicKeys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	return kids
+}
@@ -3,16 +3,9 @@ package certificate
 
 import (
 	"image"
-	"image/color"
-	"image/jpeg"
-	"image/png"
-	"io/ioutil"
-	"log"
-	"os"
-
-	"golang.org/x/image/font"
-	"golang.org/x/image/font/opentype"
-	"golang.org/x/image/math/fixed"
+	"math"
+
+	"golang.org/x/image/vector"
 )
 
 // TextRenderer handles text operations on images
@@ -25,96 +18,84 @@ func NewTextRenderer(img *image.RGBA) *TextRenderer {
 	return &TextRenderer{img: img}
 }
 
-// LoadFont loads a TrueType font from a file
-func LoadFont(fontPath string, scale float64) font.Face {
-	fontBytes, err := ioutil.ReadFile(fontPath)
-	if err != nil {
-		log.Fatalf("failed to read font file: %v", err)
-	}
-
-	f, err := opentype.Parse(fontBytes)
+// AddText shapes text with the field's font chain and draws it into the field,
+// shrinking the font from the field's max size (but not below its min size)
+// until the text fits its max width
+func (tr *TextRenderer) AddText(text string, field Field, fontPaths []string) error {
+	textColor, err := parseColor(field.Color)
 	if err != nil {
-		log.Fatalf("failed to parse font: %v", err)
+		return err
 	}
 
-	const dpi = 72 // standard DPI
-	fontFace, err := opentype.NewFace(f, &opentype.FaceOptions{
-		Size:    scale,
-		DPI:     dpi,
-		Hinting: font.HintingNone,
-	})
+	chain, err := newFontChain(fontPaths)
 	if err != nil {
-		log.Fatalf("failed to create font face: %v", err)
+		return err
 	}
 
-	return fontFace
-}
+	shaped := fitText(text, chain, field)
+	x, y := alignX(field, shaped.width()), float64(field.Y)
 
-// AddText adds text to an image
-func (tr *TextRenderer) AddText(text string, imgWidth, yPos int, fontScale float64, fontPath string) {
-	// Load the font face using LoadFont function
-	face := LoadFont(fontPath, fontScale)
-
-	fg := image.NewUniform(color.RGBA{255, 0, 0, 255})
-
-	// Create a new font drawer with the loaded face
-	d := &font.Drawer{
-		Dst:  tr.img,
-		Src:  fg,
-		Face: face,
+	// Find the area the glyphs cover so the rasterizer only spans that
+	bounds := &boundsPath{minX: math.Inf(1), minY: math.Inf(1), maxX: math.Inf(-1), maxY: math.Inf(-1)}
+	shaped.outline(bounds, x, y, 1)
+	if bounds.minX > bounds.maxX {
+		return nil // nothing visible, e.g. only spaces
 	}
 
-	// Measure the width of the text
-	textWidth := d.MeasureString(text).Ceil()
-
-	// Calculate the available margin and max width allowed for the text
-	availableWidth := imgWidth
-	maxWidth := int(float64(availableWidth) * 0.93)
-
-	// If the text width exceeds the max width, adjust the font scale
-	if textWidth > maxWidth {
-		// Calculate the new font scale to fit the text within the max width
-		scaleFactor := float64(maxWidth) / float64(textWidth)
-		fontScale *= scaleFactor
-
-		// Load the font face again with the new font scale
-		face = LoadFont(fontPath, fontScale)
-
-		// Update the font drawer with the new face
-		d.Face = face
-
-		// Measure the text width again with the new font scale
-		textWidth = d.MeasureString(text).Ceil()
+	rect := image.Rect(int(math.Floor(bounds.minX)), int(math.Floor(bounds.minY)),
+		int(math.Ceil(bounds.maxX)), int(math.Ceil(bounds.maxY)))
+	raster := &rasterPath{
+		r:  vector.NewRasterizer(rect.Dx(), rect.Dy()),
+		dx: float64(rect.Min.X),
+		dy: float64(rect.Min.Y),
 	}
+	shaped.outline(raster, x, y, 1)
+	raster.r.Draw(tr.img, rect, image.NewUniform(textColor), image.Point{})
 
-	// Calculate the starting point to center the text
-	point := fixed.Point26_6{
-		X: fixed.Int26_6((availableWidth - textWidth) / 2 * 64), // Center the text
-		Y: fixed.Int26_6(yPos * 64),
-	}
+	return nil
+}
 
-	d.Dot = point      // Set the starting point for the text
-	d.DrawString(text) // Draw the string
+// boundsPath records the bounding box of the points it is given
+type boundsPath struct {
+	minX, minY, maxX, maxY float64
 }
 
-// LoadQRCode loads a QR code image from file
-func LoadQRCode(path string) (image.Image, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
+func (b *boundsPath) add(x, y float64) {
+	b.minX, b.maxX = math.Min(b.minX, x), math.Max(b.maxX, x)
+	b.minY, b.maxY = math.Min(b.minY, y), math.Max(b.maxY, y)
+}
 
-	return png.Decode(file)
+func (b *boundsPath) MoveTo(x, y float64)         { b.add(x, y) }
+func (b *boundsPath) LineTo(x, y float64)         { b.add(x, y) }
+func (b *boundsPath) QuadTo(cx, cy, x, y float64) { b.add(cx, cy); b.add(x, y) }
+func (b *boundsPath) CubeTo(cx0, cy0, cx1, cy1, x, y float64) {
+	b.add(cx0, cy0)
+	b.add(cx1, cy1)
+	b.add(x, y)
 }
+func (b *boundsPath) ClosePath() {}
 
-// SaveAsJPEG saves an RGBA image as JPEG
-func SaveAsJPEG(img *image.RGBA, path string) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+// rasterPath feeds glyph outlines into a rasterizer whose origin is at (dx, dy)
+type rasterPath struct {
+	r      *vector.Rasterizer
+	dx, dy float64
+}
 
-	return jpeg.Encode(file, img, nil)
+func (p *rasterPath) pt(x, y float64) (float32, float32) {
+	return float32(x - p.dx), float32(y - p.dy)
+}
+
+func (p *rasterPath) MoveTo(x, y float64) { p.r.MoveTo(p.pt(x, y)) }
+func (p *rasterPath) LineTo(x, y float64) { p.r.LineTo(p.pt(x, y)) }
+func (p *rasterPath) QuadTo(cx, cy, x, y float64) {
+	bx, by := p.pt(cx, cy)
+	ex, ey := p.pt(x, y)
+	p.r.QuadTo(bx, by, ex, ey)
+}
+func (p *rasterPath) CubeTo(cx0, cy0, cx1, cy1, x, y float64) {
+	bx, by := p.pt(cx0, cy0)
+	cx, cy := p.pt(cx1, cy1)
+	ex, ey := p.pt(x, y)
+	p.r.CubeTo(bx, by, cx, cy, ex, ey)
 }
+func (p *rasterPath) ClosePath() { p.r.ClosePath() }
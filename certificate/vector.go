@@ -0,0 +1,177 @@
+// certificate/vector.go
+package certificate
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/jung-kurt/gofpdf"
+	"github.com/skip2/go-qrcode"
+)
+
+const pointsPerMM = 72 / 25.4
+
+// vectorPage maps template pixel coordinates onto a PDF page in millimetres
+type vectorPage struct {
+	pdf   *gofpdf.Fpdf
+	scale float64 // mm per template pixel
+	fonts map[string]string
+}
+
+// buildVectorPDF lays out a certificate with the template as the page background,
+// fields drawn as embedded TrueType text and the QR code drawn as rectangles
+func (g *Generator) buildVectorPDF(values map[string]string, data CertificateData) (*gofpdf.Fpdf, error) {
+	pdf := newPDF(data.IssuedAt)
+	pdf.SetMargins(0, 0, 0)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.AddPage()
+
+	pageWidth, pageHeight := pdf.GetPageSize()
+	page := &vectorPage{
+		pdf:   pdf,
+		scale: pageWidth / float64(g.Layout.Width),
+		fonts: make(map[string]string),
+	}
+
+	// Template as the background
+	options := gofpdf.ImageOptions{ImageType: "JPG"}
+	pdf.RegisterImageOptionsReader("template", options, bytes.NewReader(g.templateJPEG))
+	pdf.ImageOptions("template", 0, 0, pageWidth, pageHeight, false, options, 0, "")
+
+	for _, field := range g.Layout.Fields {
+		text := fieldValue(field, values)
+		if text == "" {
+			continue
+		}
+		if err := page.addText(text, field, g.fieldFonts(field)); err != nil {
+			return nil, fmt.Errorf("failed to draw field %q: %v", field.Name, err)
+		}
+	}
+
+	if err := page.addQRCode(g.verifyURL(data), g.Layout.QR); err != nil {
+		return nil, fmt.Errorf("failed to add QR code: %v", err)
+	}
+
+	return pdf, pdf.Error()
+}
+
+// addFont embeds a font file once per document and returns its family name
+func (p *vectorPage) addFont(fontPath string) (string, error) {
+	if family, ok := p.fonts[fontPath]; ok {
+		return family, nil
+	}
+
+	fontBytes, err := os.ReadFile(fontPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read font file: %v", err)
+	}
+	family := fmt.Sprintf("field%d", len(p.fonts))
+	p.pdf.AddUTF8FontFromBytes(family, "", fontBytes)
+	if err := p.pdf.Error(); err != nil {
+		return "", fmt.Errorf("failed to embed font %s: %v", fontPath, err)
+	}
+	p.fonts[fontPath] = family
+	return family, nil
+}
+
+// addText draws a field, shrinking it the same way the raster renderer does.
+// Plain text in the primary font is written as real PDF text. Text that needs
+// shaping or fallback fonts is drawn as glyph outlines, with an invisible copy
+// of the text on top so it can still be selected and searched.
+func (p *vectorPage) addText(text string, field Field, fontPaths []string) error {
+	textColor, err := parseColor(field.Color)
+	if err != nil {
+		return err
+	}
+
+	chain, err := newFontChain(fontPaths)
+	if err != nil {
+		return err
+	}
+
+	shaped := fitText(text, chain, field)
+	x := alignX(field, shaped.width()) * p.scale
+	y := float64(field.Y) * p.scale
+
+	p.pdf.SetTextColor(int(textColor.R), int(textColor.G), int(textColor.B))
+
+	// Layout sizes are in template pixels; convert to points on the page
+	fontSize := shaped.size * p.scale * pointsPerMM
+
+	if shaped.isSimple() {
+		family, err := p.addFont(chain.paths[0])
+		if err != nil {
+			return err
+		}
+		p.pdf.SetFont(family, "", fontSize)
+		p.pdf.Text(x, y, text)
+		return p.pdf.Error()
+	}
+
+	p.pdf.SetFillColor(int(textColor.R), int(textColor.G), int(textColor.B))
+	shaped.outline(&pdfPath{pdf: p.pdf}, x, y, p.scale)
+	p.pdf.DrawPath("F")
+
+	p.pdf.SetAlpha(0, "Normal")
+	dot := x
+	for _, run := range shaped.runs {
+		family, err := p.addFont(chain.pathOf(run.Face))
+		if err != nil {
+			return err
+		}
+		p.pdf.SetFont(family, "", fontSize)
+		p.pdf.Text(dot, y, shaped.runText(run))
+		dot += float64(run.Advance) / 64 * p.scale
+	}
+	p.pdf.SetAlpha(1, "Normal")
+
+	return p.pdf.Error()
+}
+
+// pdfPath adds glyph outlines to the current PDF path
+type pdfPath struct {
+	pdf *gofpdf.Fpdf
+}
+
+func (p *pdfPath) MoveTo(x, y float64)         { p.pdf.MoveTo(x, y) }
+func (p *pdfPath) LineTo(x, y float64)         { p.pdf.LineTo(x, y) }
+func (p *pdfPath) QuadTo(cx, cy, x, y float64) { p.pdf.CurveTo(cx, cy, x, y) }
+func (p *pdfPath) CubeTo(cx0, cy0, cx1, cy1, x, y float64) {
+	p.pdf.CurveBezierCubicTo(cx0, cy0, cx1, cy1, x, y)
+}
+func (p *pdfPath) ClosePath() { p.pdf.ClosePath() }
+
+// addQRCode draws the QR code modules as filled rectangles on a white square
+func (p *vectorPage) addQRCode(url string, box QRBox) error {
+	qr, err := qrcode.New(url, qrcode.Medium)
+	if err != nil {
+		return fmt.Errorf("failed to generate QR code: %v", err)
+	}
+
+	bitmap := qr.Bitmap()
+	x, y := float64(box.X)*p.scale, float64(box.Y)*p.scale
+	size := float64(box.Size) * p.scale
+	module := size / float64(len(bitmap))
+
+	p.pdf.SetFillColor(255, 255, 255)
+	p.pdf.Rect(x, y, size, size, "F")
+
+	// Merge horizontal runs of dark modules into one rectangle each
+	p.pdf.SetFillColor(0, 0, 0)
+	for row, cells := range bitmap {
+		for col := 0; col < len(cells); {
+			if !cells[col] {
+				col++
+				continue
+			}
+			start := col
+			for col < len(cells) && cells[col] {
+				col++
+			}
+			p.pdf.Rect(x+float64(start)*module, y+float64(row)*module, float64(col-start)*module, module, "F")
+		}
+	}
+
+	return p.pdf.Error()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const clientIPContextKey contextKey = "clientIP"
+
+// clientIPResolver finds the client behind the configured trusted proxies
+type clientIPResolver struct {
+	trusted []netip.Prefix
+	header  string // canonical name of the header the proxies set
+}
+
+// resolver is the one startServer configured; until then no proxy is trusted
+var resolver = clientIPResolver{}
+
+// clientIPMiddleware resolves the client IP once and puts it in the request
+// context for getClientIP
+func clientIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPContextKey, resolver.resolve(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (c clientIPResolver) isTrusted(addr netip.Addr) bool {
+	for _, prefix := range c.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the client IP of the request. The forwarding header is only
+// read when the peer is a trusted proxy, and is walked from the right, where
+// the nearest proxy appended its peer, past the other trusted proxies. The
+// first untrusted address is the client; everything left of it was sent by
+// the client and can be forged.
+func (c clientIPResolver) resolve(r *http.Request) string {
+	peer, ok := parseForwardedAddr(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+	if !c.isTrusted(peer) {
+		return peer.String()
+	}
+
+	var hops []string
+	switch c.header {
+	case "Forwarded":
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	case "X-Forwarded-For":
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	case "X-Real-Ip":
+		if value := r.Header.Get("X-Real-IP"); value != "" {
+			hops = []string{value}
+		}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseForwardedAddr(hops[i])
+		if !ok {
+			// An "unknown" or obfuscated hop: the last address a trusted
+			// proxy vouched for is as close to the client as we can get
+			break
+		}
+		client = addr
+		if !c.isTrusted(addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedFor returns the for= parameter of every element of the Forwarded
+// headers (RFC 7239), in order. Elements without one give an empty hop.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, val, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					hop = val
+					break
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseForwardedAddr parses an address as it appears in RemoteAddr or a
+// forwarding header: optionally quoted, with or without a port, and IPv6 in
+// brackets when it has one. IPv4-mapped IPv6 addresses become IPv4 and zones
+// are dropped.
+func parseForwardedAddr(value string) (netip.Addr, bool) {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	} else {
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
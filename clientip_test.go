@@ -0,0 +1,224 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.0/8"),
+		netip.MustParsePrefix("::1/128"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}
+
+	tests := []struct {
+		name    string
+		header  string // the configured forwarded header
+		remote  string
+		headers map[string][]string
+		want    string
+	}{
+		{
+			name:   "untrusted peer with forged X-Forwarded-For",
+			header: "X-Forwarded-For",
+			remote: "203.0.113.9:51234",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"1.2.3.4"},
+				"X-Real-Ip":       {"1.2.3.4"},
+				"Forwarded":       {"for=1.2.3.4"},
+			},
+			want: "203.0.113.9",
+		},
+		{
+			name:    "untrusted IPv6 peer",
+			header:  "X-Forwarded-For",
+			remote:  "[2001:db8::5]:443",
+			headers: map[string][]string{"X-Forwarded-For": {"1.2.3.4"}},
+			want:    "2001:db8::5",
+		},
+		{
+			name:    "trusted peer without a header",
+			header:  "X-Forwarded-For",
+			remote:  "127.0.0.1:8080",
+			headers: nil,
+			want:    "127.0.0.1",
+		},
+		{
+			name:   "right to left past several trusted hops",
+			header: "X-Forwarded-For",
+			remote: "127.0.0.1:8080",
+			// The client forged the leftmost entry
+			headers: map[string][]string{"X-Forwarded-For": {"6.6.6.6, 198.51.100.7, 10.0.0.2", "10.1.2.3"}},
+			want:    "198.51.100.7",
+		},
+		{
+			name:    "every hop trusted",
+			header:  "X-Forwarded-For",
+			remote:  "127.0.0.1:8080",
+			headers: map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:    "10.0.0.3",
+		},
+		{
+			name:    "unknown hop",
+			header:  "X-Forwarded-For",
+			remote:  "127.0.0.1:8080",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.7, unknown, 10.0.0.2"}},
+			want:    "10.0.0.2",
+		},
+		{
+			name:    "header other than the configured one is ignored",
+			header:  "X-Forwarded-For",
+			remote:  "127.0.0.1:8080",
+			headers: map[string][]string{"Forwarded": {"for=6.6.6.6"}, "X-Real-Ip": {"6.6.6.6"}},
+			want:    "127.0.0.1",
+		},
+		{
+			name:    "Forwarded with a bracketed IPv6 address and port",
+			header:  "Forwarded",
+			remote:  "[::1]:8080",
+			headers: map[string][]string{"Forwarded": {`for="[2001:db8::1]:443";proto=https`}},
+			want:    "2001:db8::1",
+		},
+		{
+			name:   "Forwarded walked right to left",
+			header: "Forwarded",
+			remote: "127.0.0.1:8080",
+			headers: map[string][]string{"Forwarded": {
+				`for=6.6.6.6, For="198.51.100.7:4711";by=10.0.0.2`,
+				`proto=https;for=10.0.0.2`,
+			}},
+			want: "198.51.100.7",
+		},
+		{
+			name:    "Forwarded unknown hop",
+			header:  "Forwarded",
+			remote:  "127.0.0.1:8080",
+			headers: map[string][]string{"Forwarded": {"for=198.51.100.7, for=unknown"}},
+			want:    "127.0.0.1",
+		},
+		{
+			name:    "Forwarded obfuscated hop",
+			header:  "Forwarded",
+			remote:  "127.0.0.1:8080",
+			headers: map[string][]string{"Forwarded": {"for=198.51.100.7, for=_hidden, for=10.0.0.2"}},
+			want:    "10.0.0.2",
+		},
+		{
+			name:    "X-Real-IP",
+			header:  "X-Real-Ip",
+			remote:  "127.0.0.1:8080",
+			headers: map[string][]string{"X-Real-Ip": {"192.0.2.1"}},
+			want:    "192.0.2.1",
+		},
+		{
+			name:    "X-Real-IP from an untrusted peer",
+			header:  "X-Real-Ip",
+			remote:  "192.0.2.50:8080",
+			headers: map[string][]string{"X-Real-Ip": {"192.0.2.1"}},
+			want:    "192.0.2.50",
+		},
+		{
+			name:    "IPv4-mapped IPv6 peer",
+			header:  "X-Forwarded-For",
+			remote:  "[::ffff:127.0.0.1]:8080",
+			headers: map[string][]string{"X-Forwarded-For": {"192.0.2.2"}},
+			want:    "192.0.2.2",
+		},
+		{
+			name:    "IPv4-mapped IPv6 hop",
+			header:  "X-Forwarded-For",
+			remote:  "127.0.0.1:8080",
+			headers: map[string][]string{"X-Forwarded-For": {"::ffff:192.0.2.3"}},
+			want:    "192.0.2.3",
+		},
+		{
+			name:    "RemoteAddr without a port",
+			header:  "X-Forwarded-For",
+			remote:  "pipe",
+			headers: map[string][]string{"X-Forwarded-For": {"192.0.2.4"}},
+			want:    "pipe",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			r.Header = http.Header(tt.headers)
+			if r.Header == nil {
+				r.Header = http.Header{}
+			}
+			resolver := clientIPResolver{trusted: trusted, header: tt.header}
+			if got := resolver.resolve(r); got != tt.want {
+				t.Errorf("resolve = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	got := forwardedFor([]string{
+		`for=192.0.2.60;proto=http;by=203.0.113.43`,
+		`proto=https, FOR="[2001:db8:cafe::17]:4711", for=unknown`,
+	})
+	want := []string{"192.0.2.60", "", `"[2001:db8:cafe::17]:4711"`, "unknown"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("forwardedFor = %q, want %q", got, want)
+	}
+}
+
+func TestParseForwardedAddr(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string // empty if it isn't an address
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:8080", "192.0.2.1"},
+		{" 192.0.2.1 ", "192.0.2.1"},
+		{`"192.0.2.1:8080"`, "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{`"[2001:db8::1]:443"`, "2001:db8::1"},
+		{"[fe80::1%eth0]:443", "fe80::1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"[::ffff:192.0.2.1]:80", "192.0.2.1"},
+		{"unknown", ""},
+		{"_hidden", ""},
+		{"", ""},
+		{"example.com:80", ""},
+	}
+	for _, tt := range tests {
+		addr, ok := parseForwardedAddr(tt.value)
+		got := ""
+		if ok {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("parseForwardedAddr(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestClientIPMiddleware(t *testing.T) {
+	defer func(previous clientIPResolver) { resolver = previous }(resolver)
+	resolver = clientIPResolver{trusted: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, header: "X-Forwarded-For"}
+
+	var got string
+	handler := clientIPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Headers changed after the middleware don't change the resolved IP
+		r.Header.Set("X-Forwarded-For", "6.6.6.6")
+		got = getClientIP(r)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:8080"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if got != "198.51.100.7" {
+		t.Errorf("getClientIP in the handler = %q, want %q", got, "198.51.100.7")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/Sathimantha/goqr/certificate"
+	"github.com/Sathimantha/goqr/secondaryfunctions"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.commit=... -X main.buildTime=..."
+// When unset they fall back to the VCS details Go embeds in the binary.
+var (
+	commit    = ""
+	buildTime = ""
+)
+
+// readinessCheck is the outcome of one /readyz check
+type readinessCheck struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// readinessChecks are run in order by /readyz; each returns nil when the
+// server can rely on that dependency
+var readinessChecks = []struct {
+	name  string
+	check func(r *http.Request) error
+}{
+	{"database", func(r *http.Request) error { return secondaryfunctions.PingDB(r.Context()) }},
+	{"templates", checkTemplates},
+	{"output_dir", checkOutputDir},
+	{"queue", checkQueue},
+}
+
+// healthzHandler reports that the process is up and serving requests
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	sendJSONResponse(w, map[string]string{"status": "ok"}, http.StatusOK)
+}
+
+// readyzHandler reports whether the server can handle traffic: the database
+// answers, templates and fonts are readable, certificates can be written and
+// the generation queue isn't saturated. It answers 503 while shutting down.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-serverShutdown:
+		sendJSONResponse(w, map[string]string{"status": "shutting down"}, http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	ready := true
+	checks := make(map[string]readinessCheck, len(readinessChecks))
+	for _, c := range readinessChecks {
+		started := time.Now()
+		err := c.check(r)
+		result := readinessCheck{OK: err == nil, Duration: time.Since(started).Round(time.Microsecond).String()}
+		if err != nil {
+			ready = false
+			result.Error = err.Error()
+		}
+		checks[c.name] = result
+	}
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not ready", http.StatusServiceUnavailable
+	}
+	sendJSONResponse(w, map[string]interface{}{"status": status, "checks": checks}, code)
+}
+
+func checkTemplates(r *http.Request) error {
+	registry, err := secondaryfunctions.Templates()
+	if err != nil {
+		return err
+	}
+	return registry.CheckFiles()
+}
+
+// checkOutputDir writes and removes a probe file. It carries the temp suffix
+// so the cleanup task removes it if the process dies in between.
+func checkOutputDir(r *http.Request) error {
+	file, err := os.CreateTemp(secondaryfunctions.ServerConfig.OutputDir, ".readyz-*"+certificate.TempSuffix)
+	if err != nil {
+		return fmt.Errorf("output directory is not writable: %v", err)
+	}
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return fmt.Errorf("error removing probe %s: %v", filepath.Base(file.Name()), err)
+	}
+	return nil
+}
+
+func checkQueue(r *http.Request) error {
+	depth, err := secondaryfunctions.QueueDepth()
+	if err != nil {
+		return err
+	}
+	if limit := secondaryfunctions.JobConfig.MaxQueued; limit > 0 && depth >= limit {
+		return fmt.Errorf("generation queue is saturated: %d jobs queued (limit %d)", depth, limit)
+	}
+	return nil
+}
+
+// buildInfo returns the commit and build time, preferring the -ldflags values
+func buildInfo() (string, string) {
+	revision, built, modified := commit, buildTime, false
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if revision == "" {
+					revision = setting.Value
+				}
+			case "vcs.time":
+				if built == "" {
+					built = setting.Value
+				}
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+	}
+	if revision == "" {
+		revision = "unknown"
+	} else if modified && commit == "" {
+		revision += "-dirty"
+	}
+	if built == "" {
+		built = "unknown"
+	}
+	return revision, built
+}
+
+// configHash fingerprints the effective server and queue settings so
+// instances can be compared without exposing them
+func configHash() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%+v|%+v", secondaryfunctions.ServerConfig, secondaryfunctions.JobConfig)))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// versionHandler reports what build is running and with which configuration
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	revision, built := buildInfo()
+	sendJSONResponse(w, map[string]string{
+		"commit":      revision,
+		"build_time":  built,
+		"go_version":  runtime.Version(),
+		"config_hash": configHash(),
+	}, http.StatusOK)
+}
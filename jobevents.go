@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sathimantha/goqr/secondaryfunctions"
+	"github.com/gorilla/mux"
+)
+
+// jobProtocolVersion is the version of the job event schema sent over the
+// WebSocket, Server-Sent Events and returned by /api/jobs/{id}
+const jobProtocolVersion = 1
+
+// Job events
+const (
+	jobEventQueued   = "queued"   // waiting for a worker; position counts the jobs ahead
+	jobEventStarted  = "started"  // a worker is generating the certificate
+	jobEventProgress = "progress" // an attempt failed and the job will be retried at retry_at
+	jobEventComplete = "complete" // the certificate is ready at download_url
+	jobEventFailed   = "failed"   // the job gave up; reason says why
+	jobEventIdle     = "idle"     // the student has no job and no current certificate
+)
+
+// jobEvent is one message of the job event protocol
+type jobEvent struct {
+	Version     int        `json:"version"`
+	Event       string     `json:"event"`
+	StudentID   string     `json:"student_id"`
+	JobID       int64      `json:"job_id,omitempty"`
+	Attempts    int        `json:"attempts,omitempty"`
+	Position    *int       `json:"position,omitempty"`
+	RetryAt     *time.Time `json:"retry_at,omitempty"`
+	DownloadURL string     `json:"download_url,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	Timestamp   time.Time  `json:"timestamp"`
+}
+
+// jobSubscribers holds the channels of the WebSocket and SSE clients waiting
+// on each student's certificate
+var jobSubscribers = struct {
+	sync.RWMutex
+	clients map[string]map[chan jobEvent]bool // studentID -> subscribers
+}{
+	clients: make(map[string]map[chan jobEvent]bool),
+}
+
+func subscribeJobEvents(studentID string) chan jobEvent {
+	events := make(chan jobEvent, 8)
+	jobSubscribers.Lock()
+	if _, exists := jobSubscribers.clients[studentID]; !exists {
+		jobSubscribers.clients[studentID] = make(map[chan jobEvent]bool)
+	}
+	jobSubscribers.clients[studentID][events] = true
+	jobSubscribers.Unlock()
+	return events
+}
+
+func unsubscribeJobEvents(studentID string, events chan jobEvent) {
+	jobSubscribers.Lock()
+	delete(jobSubscribers.clients[studentID], events)
+	if len(jobSubscribers.clients[studentID]) == 0 {
+		delete(jobSubscribers.clients, studentID)
+	}
+	jobSubscribers.Unlock()
+}
+
+// publishJobEvent sends an event to every subscriber of the student. A
+// subscriber that isn't keeping up misses the event; it can fetch the current
+// state from /api/jobs/{id}.
+func publishJobEvent(event jobEvent) {
+	jobSubscribers.RLock()
+	defer jobSubscribers.RUnlock()
+	for events := range jobSubscribers.clients[event.StudentID] {
+		select {
+		case events <- event:
+		default:
+			log.Printf("Dropped %s job event for slow subscriber of %s", event.Event, event.StudentID)
+		}
+	}
+}
+
+// publicJobReason turns a job's last error into a reason that can be shown to
+// the public without exposing internal details
+func publicJobReason(lastError string) string {
+	switch lastError {
+	case "":
+		return ""
+	case secondaryfunctions.ErrCertificateRevoked.Error():
+		return "Certificate has been revoked"
+	case secondaryfunctions.ErrStudentNotFound.Error():
+		return "Student not found"
+	default:
+		return "Certificate generation failed"
+	}
+}
+
+// jobEventFor describes a job's current state as a job event
+func jobEventFor(job *secondaryfunctions.Job) jobEvent {
+	event := jobEvent{
+		Version:   jobProtocolVersion,
+		StudentID: job.StudentID,
+		JobID:     job.ID,
+		Attempts:  job.Attempts,
+		Timestamp: job.UpdatedAt,
+	}
+
+	switch job.Status {
+	case secondaryfunctions.JobQueued:
+		if job.Attempts == 0 {
+			event.Event = jobEventQueued
+			if position, err := secondaryfunctions.QueuePosition(job); err == nil {
+				event.Position = &position
+			} else {
+				log.Printf("%v", err)
+			}
+		} else {
+			retryAt := job.RunAfter
+			event.Event = jobEventProgress
+			event.RetryAt = &retryAt
+			event.Reason = publicJobReason(job.LastError)
+		}
+	case secondaryfunctions.JobRunning:
+		event.Event = jobEventStarted
+	case secondaryfunctions.JobDone:
+		event.Event = jobEventComplete
+		event.DownloadURL = "/api/generate-certificate/" + job.StudentID
+	default:
+		event.Event = jobEventFailed
+		event.Reason = publicJobReason(job.LastError)
+	}
+	return event
+}
+
+// currentJobEvent returns the state of a student's certificate for a client
+// that just connected: their latest job, or without one whether a current
+// certificate is already available
+func currentJobEvent(studentID string) (jobEvent, error) {
+	job, err := secondaryfunctions.LatestJob(studentID)
+	if err != nil {
+		return jobEvent{}, err
+	}
+	if job != nil {
+		return jobEventFor(job), nil
+	}
+
+	event := jobEvent{Version: jobProtocolVersion, Event: jobEventIdle, StudentID: studentID, Timestamp: time.Now()}
+	person, err := secondaryfunctions.GetStudent(studentID)
+	if err == secondaryfunctions.ErrStudentNotFound {
+		return event, nil
+	}
+	if err != nil {
+		return jobEvent{}, err
+	}
+	path, err := secondaryfunctions.CertificatePath(studentID)
+	if err != nil {
+		return jobEvent{}, err
+	}
+	templateKey, err := secondaryfunctions.ResolveTemplateKey(studentID)
+	if err != nil {
+		return jobEvent{}, err
+	}
+	if current, err := secondaryfunctions.CertificateIsCurrent(person.FullName, studentID, templateKey, path); err != nil {
+		return jobEvent{}, err
+	} else if current {
+		event.Event = jobEventComplete
+		event.DownloadURL = "/api/generate-certificate/" + studentID
+	}
+	return event, nil
+}
+
+// jobUpdated publishes a job's new state to its subscribers and logs final failures
+func jobUpdated(job secondaryfunctions.Job, err error) {
+	if job.Status == secondaryfunctions.JobFailed && err != secondaryfunctions.ErrCertificateRevoked {
+		remark := fmt.Sprintf("Request IP: %s | Failed to pre-generate certificate for student: %s | Attempts: %d | Error: %v",
+			job.ClientIP, job.StudentID, job.Attempts, err)
+		ctx := secondaryfunctions.WithRequestID(context.Background(), job.RequestID)
+		secondaryfunctions.LogErrorContext(ctx, "certificate_pregeneration_failure", remark)
+	}
+	publishJobEvent(jobEventFor(&job))
+}
+
+// jobStatusHandler returns the current state of a generation job
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["jobId"], 10, 64)
+	if err != nil {
+		sendJSONError(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	job, err := secondaryfunctions.GetJob(id)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to fetch job: %d | Error: %v", getClientIP(r), id, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		sendJSONError(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	sendJSONResponse(w, jobEventFor(job), http.StatusOK)
+}
+
+// sseKeepAlive is how often an idle event stream sends a comment so proxies
+// don't close it
+const sseKeepAlive = 15 * time.Second
+
+// jobEventStreamHandler streams a student's job events as Server-Sent Events,
+// for clients that can't use WebSockets. Every message is a job event under
+// its event name, starting with the current state.
+func jobEventStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendJSONError(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	studentID, ok := acceptEventStream(w, r)
+	if !ok {
+		return
+	}
+	defer releaseEventStream(getClientIP(r))
+
+	events := subscribeJobEvents(studentID)
+	defer unsubscribeJobEvents(studentID, events)
+
+	current, err := currentJobEvent(studentID)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to fetch job state for student: %s | Error: %v",
+			getClientIP(r), studentID, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Error clearing write deadline for event stream: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	eventStreamConnections.Add(1, "sse")
+	defer eventStreamConnections.Add(-1, "sse")
+
+	send := func(event jobEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Event, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	if err := send(current); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-events:
+			if err := send(event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-serverShutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Sathimantha/goqr/secondaryfunctions"
+)
+
+// Output formats of the logs commands
+const (
+	logsFormatTable = "table"
+	logsFormatJSON  = "json" // one JSON object per line
+)
+
+// logFilterFlags are the filters shared by logs tail, query and summary
+type logFilterFlags struct {
+	types  *string
+	since  *string
+	until  *string
+	ip     *string
+	format *string
+}
+
+func addLogFilterFlags(fs *flag.FlagSet) logFilterFlags {
+	return logFilterFlags{
+		types:  fs.String("type", "", "Only these error types, comma separated (e.g., 'database_error,connection_limit')"),
+		since:  fs.String("since", "", "Only entries from this time: an age such as '24h' or '7d', a date YYYY-MM-DD or an RFC 3339 time"),
+		until:  fs.String("until", "", "Only entries before this time, in the same forms as -since"),
+		ip:     fs.String("ip", "", "Only entries about requests from this client IP"),
+		format: fs.String("format", logsFormatTable, "Output format: table or json"),
+	}
+}
+
+func (f logFilterFlags) filter() (secondaryfunctions.LogFilter, error) {
+	var filter secondaryfunctions.LogFilter
+	for _, t := range strings.Split(*f.types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			filter.Types = append(filter.Types, t)
+		}
+	}
+	var err error
+	if filter.From, err = parseLogTime(*f.since); err != nil {
+		return filter, fmt.Errorf("invalid -since: %v", err)
+	}
+	if filter.To, err = parseLogTime(*f.until); err != nil {
+		return filter, fmt.Errorf("invalid -until: %v", err)
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return filter, fmt.Errorf("-since must be before -until")
+	}
+	filter.IP = strings.TrimSpace(*f.ip)
+	if *f.format != logsFormatTable && *f.format != logsFormatJSON {
+		return filter, fmt.Errorf("unsupported format: %s", *f.format)
+	}
+	return filter, nil
+}
+
+// parseLogTime reads an age before now, a local date or an RFC 3339 time.
+// An empty value is the zero time.
+func parseLogTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if age, err := secondaryfunctions.ParseAge(value); err == nil {
+		return time.Now().Add(-age), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not an age, date or RFC 3339 time", value)
+}
+
+// handleLogs runs the logs subcommands, which read and prune the errors table
+func handleLogs(args []string) error {
+	usage := fmt.Errorf("usage: logs tail|query|summary|prune [flags]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "tail":
+		tailCmd := flag.NewFlagSet("logs tail", flag.ExitOnError)
+		filters := addLogFilterFlags(tailCmd)
+		linesFlag := tailCmd.Int("n", 20, "Number of recent entries to show")
+		followFlag := tailCmd.Bool("f", false, "Keep printing new entries as they are logged")
+		intervalFlag := tailCmd.Duration("interval", 2*time.Second, "How often to check for new entries with -f")
+		if err := tailCmd.Parse(args[1:]); err != nil {
+			return fmt.Errorf("error parsing logs tail flags: %v", err)
+		}
+		filter, err := filters.filter()
+		if err != nil {
+			return err
+		}
+		if *linesFlag < 0 {
+			return fmt.Errorf("-n must not be negative")
+		}
+		if *intervalFlag <= 0 {
+			return fmt.Errorf("-interval must be positive")
+		}
+
+		return tailLogs(filter, *linesFlag, *followFlag, *intervalFlag, *filters.format)
+
+	case "query":
+		queryCmd := flag.NewFlagSet("logs query", flag.ExitOnError)
+		filters := addLogFilterFlags(queryCmd)
+		limitFlag := queryCmd.Int("limit", 100, "Maximum number of entries, the most recent ones (0 for all)")
+		if err := queryCmd.Parse(args[1:]); err != nil {
+			return fmt.Errorf("error parsing logs query flags: %v", err)
+		}
+		filter, err := filters.filter()
+		if err != nil {
+			return err
+		}
+		if *limitFlag < 0 {
+			return fmt.Errorf("-limit must not be negative")
+		}
+		filter.Limit = *limitFlag
+
+		entries, err := secondaryfunctions.QueryLogs(filter)
+		if err != nil {
+			return err
+		}
+		return writeLogEntries(os.Stdout, entries, *filters.format, true)
+
+	case "summary":
+		summaryCmd := flag.NewFlagSet("logs summary", flag.ExitOnError)
+		filters := addLogFilterFlags(summaryCmd)
+		if err := summaryCmd.Parse(args[1:]); err != nil {
+			return fmt.Errorf("error parsing logs summary flags: %v", err)
+		}
+		if *filters.since == "" {
+			*filters.since = "7d"
+		}
+		filter, err := filters.filter()
+		if err != nil {
+			return err
+		}
+
+		counts, err := secondaryfunctions.SummarizeLogs(filter)
+		if err != nil {
+			return err
+		}
+		return writeLogSummary(os.Stdout, counts, *filters.format)
+
+	case "prune":
+		pruneCmd := flag.NewFlagSet("logs prune", flag.ExitOnError)
+		olderThanFlag := pruneCmd.String("older-than", "", "Delete entries older than this age (e.g., '90d' or '720h')")
+		dryRunFlag := pruneCmd.Bool("dry-run", false, "Only count the entries that would be deleted")
+		if err := pruneCmd.Parse(args[1:]); err != nil {
+			return fmt.Errorf("error parsing logs prune flags: %v", err)
+		}
+		if *olderThanFlag == "" {
+			return fmt.Errorf("-older-than is required")
+		}
+		age, err := secondaryfunctions.ParseAge(*olderThanFlag)
+		if err != nil {
+			return err
+		}
+
+		return pruneLogs(time.Now().Add(-age), *dryRunFlag)
+
+	default:
+		return usage
+	}
+}
+
+// tailLogs prints the last entries and, when following, polls for new ones
+// until interrupted
+func tailLogs(filter secondaryfunctions.LogFilter, lines int, follow bool, interval time.Duration, format string) error {
+	var lastID int64
+	if lines > 0 {
+		filter.Limit = lines
+		entries, err := secondaryfunctions.QueryLogs(filter)
+		if err != nil {
+			return err
+		}
+		if err := writeLogEntries(os.Stdout, entries, format, true); err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			lastID = entries[len(entries)-1].ID
+		}
+	}
+	if !follow {
+		return nil
+	}
+
+	// Start after the newest entry even if none were shown
+	if lastID == 0 {
+		latest, err := secondaryfunctions.QueryLogs(secondaryfunctions.LogFilter{Limit: 1})
+		if err != nil {
+			return err
+		}
+		if len(latest) > 0 {
+			lastID = latest[0].ID
+		}
+	}
+	filter.Limit = 0
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	header := lines == 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		filter.AfterID = lastID
+		entries, err := secondaryfunctions.QueryLogs(filter)
+		if err != nil {
+			// The database may come back; keep following
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			continue
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		if err := writeLogEntries(os.Stdout, entries, format, header); err != nil {
+			return err
+		}
+		header = false
+		lastID = entries[len(entries)-1].ID
+	}
+}
+
+// writeLogEntries prints entries as an aligned table or as JSON lines.
+// Multi-line remarks are folded onto one line in the table.
+func writeLogEntries(out io.Writer, entries []secondaryfunctions.LogEntry, format string, header bool) error {
+	if format == logsFormatJSON {
+		encoder := json.NewEncoder(out)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if header {
+		fmt.Fprintln(w, "ID\tTIME\tTYPE\tREMARK")
+	}
+	for _, entry := range entries {
+		remark := strings.ReplaceAll(strings.TrimSpace(entry.Remark), "\n", " | ")
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", entry.ID, entry.Timestamp.Format("2006-01-02 15:04:05"), entry.Type, remark)
+	}
+	return w.Flush()
+}
+
+// writeLogSummary prints the counts per day and type
+func writeLogSummary(out io.Writer, counts []secondaryfunctions.LogCount, format string) error {
+	if format == logsFormatJSON {
+		encoder := json.NewEncoder(out)
+		for _, count := range counts {
+			if err := encoder.Encode(count); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DAY\tTYPE\tCOUNT")
+	total := 0
+	for _, count := range counts {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", count.Day, count.Type, count.Count)
+		total += count.Count
+	}
+	fmt.Fprintf(w, "\tTotal\t%d\n", total)
+	return w.Flush()
+}
+
+// pruneLogs deletes the entries logged before the cutoff
+func pruneLogs(before time.Time, dryRun bool) error {
+	if dryRun {
+		count, err := secondaryfunctions.CountLogsBefore(before)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Would delete %d log entries from before %s\n", count, before.Format(time.RFC3339))
+		return nil
+	}
+
+	pruned, err := secondaryfunctions.PruneLogs(before)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %d log entries from before %s\n", pruned, before.Format(time.RFC3339))
+	return nil
+}
@@ -1,320 +1,562 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Sathimantha/goqr/certificate"
 	"github.com/Sathimantha/goqr/secondaryfunctions"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
 )
 
-var (
-	templateDir = filepath.Join(os.Getenv("PWD"), "templates")
-	generator   *certificate.Generator
-)
+var templates *certificate.Registry
 
-var (
-	certificateGenerationTracker = struct {
-		sync.RWMutex
-		inProgress map[string]bool
-		completed  map[string]time.Time
-	}{
-		inProgress: make(map[string]bool),
-		completed:  make(map[string]time.Time),
-	}
-)
+// allowedOrigins may call the API from a browser and open WebSockets
+var allowedOrigins = []string{
+	"https://cpcglobal.org",
+	"https://cdn.cpcglobal.org",
+}
 
-// Add WebSocket upgrader
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Or implement proper origin checking
-	},
+// defaultConfigFile is read when it exists and no other config file is given
+const defaultConfigFile = "config.json"
+
+// serverFlags registers the server settings as flags writing into cfg, with
+// its current values as defaults
+func serverFlags(fs *flag.FlagSet, cfg *secondaryfunctions.ServerSettings) {
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "Address to listen on")
+	fs.BoolVar(&cfg.TLS, "tls", cfg.TLS, "Serve HTTPS with -cert and -key; disable behind a TLS-terminating proxy")
+	fs.StringVar(&cfg.CertFile, "cert", cfg.CertFile, "TLS certificate file")
+	fs.StringVar(&cfg.KeyFile, "key", cfg.KeyFile, "TLS key file")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout, "Maximum time to read a request, including the body")
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", cfg.ReadHeaderTimeout, "Maximum time to read request headers")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", cfg.WriteTimeout, "Maximum time to write a response")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "How long idle keep-alive connections stay open")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "How long to wait for requests and generation jobs when stopping")
+	fs.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", cfg.MaxHeaderBytes, "Maximum size of request headers")
+	fs.StringVar(&cfg.TemplateDir, "template-dir", cfg.TemplateDir, "Directory with the HTML pages")
+	fs.StringVar(&cfg.AssetsDir, "assets-dir", cfg.AssetsDir, "Directory with certificate templates, layouts and fonts")
+	fs.StringVar(&cfg.OutputDir, "output-dir", cfg.OutputDir, "Directory generated certificates are written to")
+	fs.StringVar(&cfg.BaseURL, "base-url", cfg.BaseURL, "Public address of the site, used in QR codes")
 }
 
-// Add WebSocket client tracking
-var (
-	clientConnections = struct {
-		sync.RWMutex
-		clients map[string]map[*websocket.Conn]bool // studentID -> connections
-	}{
-		clients: make(map[string]map[*websocket.Conn]bool),
+// loadConfig builds secondaryfunctions.ServerConfig from the defaults, a config
+// file, environment variables and the flags before the command, each overriding
+// the one before. It returns the remaining arguments: the command and its flags.
+func loadConfig(args []string) ([]string, error) {
+	configFile := os.Getenv("CONFIG_FILE")
+	defaultFile := configFile == ""
+	if defaultFile {
+		configFile = defaultConfigFile
 	}
-)
 
-func init() {
-	currentDir, err := filepath.Abs(".")
-	if err != nil {
-		log.Fatalf("Error getting current directory: %v\n", err)
+	// The config file has to be known before the flags can be applied over it,
+	// so parse once for -config and again once the file and environment are loaded
+	first := flag.NewFlagSet("goqr", flag.ContinueOnError)
+	first.SetOutput(io.Discard)
+	scratch := secondaryfunctions.ServerConfig
+	serverFlags(first, &scratch)
+	configFlag := first.String("config", configFile, "")
+	if err := first.Parse(args); err == nil {
+		first.Visit(func(f *flag.Flag) {
+			if f.Name == "config" {
+				configFile, defaultFile = *configFlag, false
+			}
+		})
 	}
 
-	fontPath := "assets/Roboto-Regular.ttf"
-	generator = certificate.NewGenerator(currentDir, filepath.Join(currentDir, "generated_files"), fontPath)
+	if err := secondaryfunctions.LoadServerConfig(configFile, !defaultFile); err != nil {
+		return nil, err
+	}
 
-	go func() {
-		for {
-			time.Sleep(time.Hour)
-			certificateGenerationTracker.Lock()
-			for id, completedTime := range certificateGenerationTracker.completed {
-				if time.Since(completedTime) > 24*time.Hour {
-					delete(certificateGenerationTracker.completed, id)
-				}
-			}
-			certificateGenerationTracker.Unlock()
-		}
-	}()
+	fs := flag.NewFlagSet("goqr", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: goqr [flags] [command [command flags]]\n\nWithout a command the server is started.\n\n")
+		fs.PrintDefaults()
+	}
+	serverFlags(fs, &secondaryfunctions.ServerConfig)
+	fs.String("config", configFile, "JSON config file (or CONFIG_FILE); settings are overridden by environment variables and flags")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return fs.Args(), nil
 }
 
 // handleCommandLine processes command-line arguments and executes appropriate actions
-func handleCommandLine() error {
-	if len(os.Args) <= 1 {
+func handleCommandLine(args []string) error {
+	if len(args) == 0 {
 		return fmt.Errorf("no command provided")
 	}
 
 	// Define command-line flags
 	generateCertCmd := flag.NewFlagSet("generate-cert", flag.ExitOnError)
 	cleanupCmd := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	keygenCmd := flag.NewFlagSet("keygen", flag.ExitOnError)
+	revokeCmd := flag.NewFlagSet("revoke", flag.ExitOnError)
+	reissueCmd := flag.NewFlagSet("reissue", flag.ExitOnError)
+	importCmd := flag.NewFlagSet("students import", flag.ExitOnError)
+	exportCmd := flag.NewFlagSet("export", flag.ExitOnError)
 
 	// Flags for generate-cert
-	studentIDFlag := generateCertCmd.String("id", "", "The Student ID or range (e.g., 'ST001' or 'ST001-ST010')")
+	studentIDFlag := generateCertCmd.String("id", "", "Student IDs and ranges (e.g., 'ST001', 'ST001..ST010' or 'ST001,ST005..ST009'); '-' reads standard input")
+	idsFileFlag := generateCertCmd.String("ids-file", "", "File with one ID, list or range per line; '-' reads standard input")
+	selectFlag := generateCertCmd.String("select", "", "Select students from the database: all, without-certificate, course:<id> or template:<key>")
+	maxSpanFlag := generateCertCmd.Int("max-span", defaultMaxRangeSpan, "Maximum number of IDs a single range may expand to")
+	templateFlag := generateCertCmd.String("template", "", "Template key to use instead of the student's own template")
+	parallelFlag := generateCertCmd.Int("parallel", 1, "Number of certificates to generate at once")
+	continueFlag := generateCertCmd.Bool("continue-on-error", false, "Keep generating after a failure and report all failures at the end")
+	checkpointFlag := generateCertCmd.String("checkpoint", "", "File recording generated IDs; rerunning with the same file resumes an interrupted run")
 
 	// Flags for cleanup
 	daysOldFlag := cleanupCmd.Int("days", 10, "Delete files older than specified days")
 
+	// Flags for keygen
+	keyIDFlag := keygenCmd.String("kid", "", "ID of the new signing key (e.g., '2024-08')")
+	keyDirFlag := keygenCmd.String("dir", secondaryfunctions.SigningConfig.KeysDir, "Directory to write the key pair to")
+
+	// Flags for revoke
+	revokeIDFlag := revokeCmd.String("id", "", "The Student ID whose certificate is revoked")
+	revokeSerialFlag := revokeCmd.String("serial", "", "Serial of the certificate to revoke (defaults to the latest)")
+	revokeReasonFlag := revokeCmd.String("reason", "", "Why the certificate is revoked")
+
+	// Flags for reissue
+	reissueIDFlag := reissueCmd.String("id", "", "The Student ID to reissue a certificate for")
+	reissueTemplateFlag := reissueCmd.String("template", "", "Template key to use instead of the student's own template")
+
+	// Flags for students import
+	importFileFlag := importCmd.String("file", "", "Roster to import (.csv or .xlsx)")
+	importSheetFlag := importCmd.String("sheet", "", "XLSX sheet to read (defaults to the first sheet)")
+	importMapFlag := importCmd.String("map", "", "Column mapping as field=Header pairs (e.g., 'full_name=Name,student_id=ID')")
+	importDryRunFlag := importCmd.Bool("dry-run", false, "Validate and report without changing the database")
+	importUpsertFlag := importCmd.Bool("upsert", false, "Update students that already exist")
+	importReportFlag := importCmd.String("report", "", "Write the per-row results to this CSV file")
+	importGenerateFlag := importCmd.Bool("generate", false, "Generate certificates for the imported students")
+
+	// Flags for export
+	exportFormatFlag := exportCmd.String("format", secondaryfunctions.ExportCSV, "Output format: csv, jsonl or xlsx")
+	exportFromFlag := exportCmd.String("from", "", "Count activity from this date, YYYY-MM-DD (defaults to 30 days ago)")
+	exportToFlag := exportCmd.String("to", "", "Count activity up to and including this date, YYYY-MM-DD (defaults to today)")
+	exportCourseFlag := exportCmd.String("course", "", "Only export students enrolled in this course")
+	exportActiveFlag := exportCmd.Bool("active", false, "Only export students who downloaded or verified in the period")
+	exportOutFlag := exportCmd.String("out", "", "File to write to (defaults to standard output)")
+
 	// Process commands
-	switch os.Args[1] {
+	switch args[0] {
 	case "generate-cert":
-		if err := generateCertCmd.Parse(os.Args[2:]); err != nil {
+		if err := generateCertCmd.Parse(args[1:]); err != nil {
 			return fmt.Errorf("error parsing generate-cert flags: %v", err)
 		}
-		if *studentIDFlag == "" {
-			return fmt.Errorf("student ID or range is required")
+		if *studentIDFlag == "" && *idsFileFlag == "" && *selectFlag == "" {
+			return fmt.Errorf("student IDs are required (-id, -ids-file or -select)")
+		}
+		if err := checkTemplateKey(*templateFlag); err != nil {
+			return err
 		}
 
-		return handleGenerateCert(*studentIDFlag)
+		ids, err := resolveStudentIDs(*studentIDFlag, *idsFileFlag, *selectFlag, *maxSpanFlag)
+		if err != nil {
+			return err
+		}
+
+		if *parallelFlag < 1 {
+			return fmt.Errorf("parallel must be at least 1")
+		}
+
+		return handleGenerateCert(ids, batchOptions{
+			TemplateKey:     *templateFlag,
+			Parallel:        *parallelFlag,
+			ContinueOnError: *continueFlag,
+			Checkpoint:      *checkpointFlag,
+		})
 
 	case "cleanup":
-		if err := cleanupCmd.Parse(os.Args[2:]); err != nil {
+		if err := cleanupCmd.Parse(args[1:]); err != nil {
 			return fmt.Errorf("error parsing cleanup flags: %v", err)
 		}
 
 		return handleCleanup(*daysOldFlag)
 
+	case "keygen":
+		if err := keygenCmd.Parse(args[1:]); err != nil {
+			return fmt.Errorf("error parsing keygen flags: %v", err)
+		}
+		if *keyIDFlag == "" {
+			return fmt.Errorf("key ID is required")
+		}
+
+		return handleKeygen(*keyDirFlag, *keyIDFlag)
+
+	case "revoke":
+		if err := revokeCmd.Parse(args[1:]); err != nil {
+			return fmt.Errorf("error parsing revoke flags: %v", err)
+		}
+		if *revokeIDFlag == "" {
+			return fmt.Errorf("student ID is required")
+		}
+		if strings.TrimSpace(*revokeReasonFlag) == "" {
+			return fmt.Errorf("reason is required")
+		}
+
+		return handleRevoke(*revokeIDFlag, *revokeSerialFlag, *revokeReasonFlag)
+
+	case "reissue":
+		if err := reissueCmd.Parse(args[1:]); err != nil {
+			return fmt.Errorf("error parsing reissue flags: %v", err)
+		}
+		if *reissueIDFlag == "" {
+			return fmt.Errorf("student ID is required")
+		}
+		if err := checkTemplateKey(*reissueTemplateFlag); err != nil {
+			return err
+		}
+
+		return handleReissue(*reissueIDFlag, *reissueTemplateFlag)
+
+	case "students":
+		if len(args) < 2 || args[1] != "import" {
+			return fmt.Errorf("usage: students import -file <roster.csv|roster.xlsx>")
+		}
+		if err := importCmd.Parse(args[2:]); err != nil {
+			return fmt.Errorf("error parsing students import flags: %v", err)
+		}
+		if *importFileFlag == "" {
+			return fmt.Errorf("roster file is required")
+		}
+		mapping, err := parseColumnMapping(*importMapFlag)
+		if err != nil {
+			return err
+		}
+		options := secondaryfunctions.ImportOptions{
+			Mapping: mapping,
+			DryRun:  *importDryRunFlag,
+			Upsert:  *importUpsertFlag,
+			Admin:   "CLI import",
+		}
+
+		return handleImportStudents(*importFileFlag, *importSheetFlag, *importReportFlag, options, *importGenerateFlag)
+
+	case "export":
+		if err := exportCmd.Parse(args[1:]); err != nil {
+			return fmt.Errorf("error parsing export flags: %v", err)
+		}
+		from, to, err := secondaryfunctions.ParseDateRange(*exportFromFlag, *exportToFlag)
+		if err != nil {
+			return err
+		}
+		filter := secondaryfunctions.ExportFilter{
+			From:       from,
+			To:         to,
+			CourseID:   *exportCourseFlag,
+			ActiveOnly: *exportActiveFlag,
+		}
+
+		return handleExport(*exportOutFlag, *exportFormatFlag, filter)
+
+	case "logs":
+		return handleLogs(args[1:])
+
 	default:
-		return fmt.Errorf("unknown command: %s", os.Args[1])
+		return fmt.Errorf("unknown command: %s", args[0])
 	}
 }
 
-func parseIDRange(idRange string) (start, end string, err error) {
-	parts := strings.Split(idRange, "-")
-	if len(parts) == 1 {
-		// Single ID
-		return parts[0], parts[0], nil
-	} else if len(parts) == 2 {
-		// Range of IDs
-		start, end = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
-		if start == "" || end == "" {
-			return "", "", fmt.Errorf("invalid ID range format: %s", idRange)
+// parseColumnMapping parses field=Header pairs separated by commas
+func parseColumnMapping(value string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	if value == "" {
+		return mapping, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		field, header, found := strings.Cut(pair, "=")
+		field, header = strings.TrimSpace(field), strings.TrimSpace(header)
+		if !found || field == "" || header == "" {
+			return nil, fmt.Errorf("invalid column mapping: %q", pair)
 		}
-		return start, end, nil
+		mapping[field] = header
 	}
-	return "", "", fmt.Errorf("invalid ID range format: %s", idRange)
+	return mapping, nil
 }
 
-func generateNextID(currentID string) (string, error) {
-	// Extract the numeric part
-	i := len(currentID) - 1
-	for i >= 0 && (currentID[i] >= '0' && currentID[i] <= '9') {
-		i--
+// resolveStudentIDs combines the IDs from the -id selector, the -ids-file and
+// the -select database selection, without repeats and in the order given
+func resolveStudentIDs(selector, idsFile, selection string, maxSpan int) ([]string, error) {
+	if selector == "-" && idsFile == "-" {
+		return nil, fmt.Errorf("standard input can only be read once")
 	}
-	prefix := currentID[:i+1]
-	numStr := currentID[i+1:]
 
-	// Convert to number and increment
-	num, err := strconv.Atoi(numStr)
-	if err != nil {
-		return "", fmt.Errorf("invalid ID format: %s", currentID)
+	var ids []string
+	if selector == "-" {
+		stdinIDs, err := readSelectorFile("-", maxSpan)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, stdinIDs...)
+	} else if selector != "" {
+		selectorIDs, err := parseSelector(selector, maxSpan)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, selectorIDs...)
 	}
 
-	// Generate next ID with same padding
-	padding := len(numStr)
-	nextNum := num + 1
-	nextNumStr := fmt.Sprintf("%0*d", padding, nextNum)
-
-	return prefix + nextNumStr, nil
-}
+	if idsFile != "" {
+		fileIDs, err := readSelectorFile(idsFile, maxSpan)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, fileIDs...)
+	}
 
-// handleGenerateCert handles the certificate generation command
-func handleGenerateCert(idRange string) error {
-	start, end, err := parseIDRange(idRange)
-	if err != nil {
-		return err
+	if selection != "" {
+		selectedIDs, err := secondaryfunctions.SelectStudentIDs(selection)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, selectedIDs...)
 	}
 
-	// For single ID case
-	if start == end {
-		return generateSingleCertificate(start)
+	ids = uniqueIDs(ids)
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no student IDs selected")
 	}
+	return ids, nil
+}
 
-	// For range of IDs
-	currentID := start
-	for {
-		if err := generateSingleCertificate(currentID); err != nil {
-			return fmt.Errorf("failed at ID %s: %v", currentID, err)
-		}
+// handleGenerateCert handles the certificate generation command. A single
+// certificate is generated directly; several go through runBatch.
+func handleGenerateCert(ids []string, options batchOptions) error {
+	if len(ids) == 1 && options.Checkpoint == "" {
+		return generateSingleCertificate(ids[0], options.TemplateKey)
+	}
+	return runBatch(ids, options)
+}
 
-		if currentID == end {
-			break
-		}
+// initiateAsyncCertificateGeneration queues certificate generation for a
+// student and returns the job, which may be one already queued for them
+func initiateAsyncCertificateGeneration(ctx context.Context, studentID, clientIP string) *secondaryfunctions.Job {
+	job, created, err := secondaryfunctions.EnqueueGeneration(ctx, studentID, clientIP)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to queue certificate generation for student: %s | Error: %v",
+			clientIP, studentID, err)
+		secondaryfunctions.LogErrorContext(ctx, "certificate_pregeneration_failure", remark)
+		return nil
+	}
+	if created {
+		publishJobEvent(jobEventFor(job))
+	}
+	return job
+}
 
-		nextID, err := generateNextID(currentID)
-		if err != nil {
-			return fmt.Errorf("failed to generate next ID after %s: %v", currentID, err)
-		}
+// checkTemplateKey loads the templates for a CLI command and checks that key,
+// if set, is one of them
+func checkTemplateKey(key string) error {
+	registry, err := secondaryfunctions.Templates()
+	if err != nil {
+		return fmt.Errorf("error loading certificate templates: %v", err)
+	}
+	if key != "" && !registry.Has(key) {
+		return fmt.Errorf("unknown template: %s (available: %s)", key, strings.Join(registry.Keys(), ", "))
+	}
+	return nil
+}
 
-		currentID = nextID
+func generateSingleCertificate(studentID, templateKey string) error {
+	person, err := generateCertificateFor(studentID, templateKey)
+	if err != nil {
+		return err
 	}
 
+	fmt.Printf("Certificate successfully generated for %s (%s)\n", person.FullName, person.StudentID)
 	return nil
 }
 
-// Modify initiateAsyncCertificateGeneration to notify clients
-func initiateAsyncCertificateGeneration(studentID string, clientIP string) {
-	certificateGenerationTracker.RLock()
-	if _, inProgress := certificateGenerationTracker.inProgress[studentID]; inProgress {
-		certificateGenerationTracker.RUnlock()
-		return
+// generateCertificateFor looks up a student by exact ID and generates their certificate
+func generateCertificateFor(studentID, templateKey string) (*secondaryfunctions.Person, error) {
+	person, err := secondaryfunctions.GetStudent(studentID)
+	if err == secondaryfunctions.ErrStudentNotFound {
+		return nil, fmt.Errorf("student not found: %s", studentID)
 	}
-	if completedTime, exists := certificateGenerationTracker.completed[studentID]; exists {
-		if time.Since(completedTime) < time.Hour {
-			certificateGenerationTracker.RUnlock()
-			return
-		}
+	if err != nil {
+		return nil, err
 	}
-	certificateGenerationTracker.RUnlock()
 
-	certificateGenerationTracker.Lock()
-	if certificateGenerationTracker.inProgress[studentID] {
-		certificateGenerationTracker.Unlock()
-		return
+	if _, err := secondaryfunctions.GenerateCertificateWithTemplate(person.FullName, person.StudentID, templateKey); err != nil {
+		return nil, fmt.Errorf("failed to generate certificate for %s: %v", person.FullName, err)
 	}
-	certificateGenerationTracker.inProgress[studentID] = true
-	certificateGenerationTracker.Unlock()
+	return person, nil
+}
 
-	// Start async generation
-	go func() {
-		defer func() {
-			certificateGenerationTracker.Lock()
-			delete(certificateGenerationTracker.inProgress, studentID)
-			certificateGenerationTracker.completed[studentID] = time.Now()
-			certificateGenerationTracker.Unlock()
+// handleCleanup handles the cleanup command
+func handleCleanup(days int) error {
+	log.Printf("Starting cleanup of files older than %d days...", days)
+	return secondaryfunctions.CleanupOldFiles(days)
+}
 
-			// Notify all connected clients
-			notifyClients(studentID, "complete")
-		}()
+// handleRevoke revokes a student's certificate from the command line
+func handleRevoke(studentID, serial, reason string) error {
+	issuance, err := secondaryfunctions.RevokeCertificate(studentID, serial, reason, "CLI")
+	if err != nil {
+		return err
+	}
 
-		_, err := secondaryfunctions.GenerateCertificate(studentID, clientIP)
-		if err != nil {
-			remark := fmt.Sprintf("Request IP: %s | Failed to pre-generate certificate for student: %s | Error: %v",
-				clientIP, studentID, err)
-			secondaryfunctions.LogError("certificate_pregeneration_failure", remark)
-			notifyClients(studentID, "error")
-			return
-		}
-	}()
+	changes := map[string]string{"serial": issuance.Serial, "reason": reason}
+	if err := secondaryfunctions.RecordAudit("CLI", secondaryfunctions.AuditCertificateRevoke, studentID, "CLI", changes); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
+	}
+	fmt.Printf("Certificate %s for %s revoked\n", issuance.Serial, studentID)
+	return nil
 }
 
-// Add function to notify WebSocket clients
-func notifyClients(studentID string, status string) {
-	message := map[string]string{
-		"type":   "certificate_status",
-		"status": status,
+// handleReissue issues a new certificate that supersedes the student's latest one
+func handleReissue(studentID, templateKey string) error {
+	person, err := secondaryfunctions.GetStudent(studentID)
+	if err == secondaryfunctions.ErrStudentNotFound {
+		return fmt.Errorf("student not found: %s", studentID)
+	}
+	if err != nil {
+		return err
+	}
+
+	issuance, err := secondaryfunctions.ReissueCertificate(person.FullName, person.StudentID, templateKey)
+	if err != nil {
+		return fmt.Errorf("failed to reissue certificate for %s: %v", person.FullName, err)
 	}
 
-	clientConnections.RLock()
-	if clients, exists := clientConnections.clients[studentID]; exists {
-		for conn := range clients {
-			err := conn.WriteJSON(message)
-			if err != nil {
-				log.Printf("Failed to send WebSocket message: %v", err)
-			}
-		}
+	changes := map[string]string{"serial": issuance.Serial, "supersedes": issuance.Supersedes}
+	if err := secondaryfunctions.RecordAudit("CLI", secondaryfunctions.AuditCertificateIssue, studentID, "CLI", changes); err != nil {
+		log.Printf("Error recording audit entry: %v", err)
 	}
-	clientConnections.RUnlock()
+
+	if issuance.Supersedes != "" {
+		fmt.Printf("Certificate %s issued for %s (%s), superseding %s\n",
+			issuance.Serial, person.FullName, person.StudentID, issuance.Supersedes)
+	} else {
+		fmt.Printf("Certificate %s issued for %s (%s)\n", issuance.Serial, person.FullName, person.StudentID)
+	}
+	return nil
 }
 
-// Add WebSocket connection handler
-func websocketHandler(w http.ResponseWriter, r *http.Request) {
-	studentID := r.URL.Query().Get("studentId")
-	if studentID == "" {
-		http.Error(w, "Student ID is required", http.StatusBadRequest)
-		return
+// handleImportStudents imports a roster, prints a summary and the failed rows,
+// and optionally generates certificates for the students it created or updated
+func handleImportStudents(path, sheet, reportPath string, options secondaryfunctions.ImportOptions, generate bool) error {
+	records, err := secondaryfunctions.ReadRoster(path, sheet)
+	if err != nil {
+		return err
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	report, err := secondaryfunctions.ImportStudents(records, options)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
-		return
+		return err
+	}
+
+	for _, result := range report.Rows {
+		if result.Action == secondaryfunctions.ImportFailed {
+			fmt.Printf("Row %d (%s): %s\n", result.Row, result.StudentID, result.Error)
+		}
 	}
 
-	// Register client connection
-	clientConnections.Lock()
-	if _, exists := clientConnections.clients[studentID]; !exists {
-		clientConnections.clients[studentID] = make(map[*websocket.Conn]bool)
+	mode := ""
+	if options.DryRun {
+		mode = " (dry run, nothing was changed)"
 	}
-	clientConnections.clients[studentID][conn] = true
-	clientConnections.Unlock()
+	fmt.Printf("Imported %s%s: %d created, %d updated, %d unchanged, %d failed\n", path, mode,
+		report.Counts[secondaryfunctions.ImportCreated], report.Counts[secondaryfunctions.ImportUpdated],
+		report.Counts[secondaryfunctions.ImportUnchanged], report.Counts[secondaryfunctions.ImportFailed])
 
-	// Cleanup on disconnect
-	defer func() {
-		clientConnections.Lock()
-		delete(clientConnections.clients[studentID], conn)
-		if len(clientConnections.clients[studentID]) == 0 {
-			delete(clientConnections.clients, studentID)
+	if reportPath != "" {
+		if err := secondaryfunctions.WriteImportReport(reportPath, report); err != nil {
+			return err
 		}
-		clientConnections.Unlock()
-		conn.Close()
-	}()
+		fmt.Printf("Import report written to %s\n", reportPath)
+	}
 
-	// Keep connection alive and handle client messages
-	for {
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			break
+	if generate && !options.DryRun {
+		for _, result := range report.Rows {
+			if result.Action != secondaryfunctions.ImportCreated && result.Action != secondaryfunctions.ImportUpdated {
+				continue
+			}
+			if err := generateSingleCertificate(result.StudentID, ""); err != nil {
+				log.Printf("Error generating certificate for %s: %v", result.StudentID, err)
+			}
 		}
 	}
+
+	return nil
 }
 
-func generateSingleCertificate(studentID string) error {
-	person := secondaryfunctions.GetPerson(studentID, "CLI")
-	if person == nil {
-		return fmt.Errorf("student not found: %s", studentID)
+// handleExport writes the student report to a file or standard output. A file
+// is written next to path and renamed into place once complete, so a failed
+// export doesn't leave a truncated report behind.
+func handleExport(path, format string, filter secondaryfunctions.ExportFilter) (err error) {
+	out := os.Stdout
+	if path != "" {
+		file, createErr := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+		if createErr != nil {
+			return fmt.Errorf("error creating export file: %v", createErr)
+		}
+		defer func() {
+			if err != nil {
+				file.Close()
+				os.Remove(file.Name())
+			}
+		}()
+		out = file
 	}
 
-	if _, err := secondaryfunctions.GenerateCertificate(person.FullName, person.StudentID); err != nil {
-		return fmt.Errorf("failed to generate certificate for %s: %v", person.FullName, err)
+	writer, err := secondaryfunctions.NewExportWriter(out, format)
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Certificate successfully generated for %s (%s)\n", person.FullName, person.StudentID)
+	count := 0
+	err = secondaryfunctions.ExportStudents(filter, func(row secondaryfunctions.ExportRow) error {
+		count++
+		return writer.Write(row)
+	})
+	if err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	if path != "" {
+		if err := out.Chmod(0644); err != nil {
+			return fmt.Errorf("error setting export file permissions: %v", err)
+		}
+		if err := out.Close(); err != nil {
+			return fmt.Errorf("error writing export file: %v", err)
+		}
+		if err := os.Rename(out.Name(), path); err != nil {
+			return fmt.Errorf("error moving export file into place: %v", err)
+		}
+		fmt.Printf("Exported %d students to %s\n", count, path)
+	}
 	return nil
 }
 
-// handleCleanup handles the cleanup command
-func handleCleanup(days int) error {
-	log.Printf("Starting cleanup of files older than %d days...", days)
-	return secondaryfunctions.CleanupOldFiles(days)
+// handleKeygen creates a new certificate signing key pair
+func handleKeygen(dir, kid string) error {
+	if err := certificate.GenerateKey(dir, kid); err != nil {
+		return err
+	}
+	fmt.Printf("Signing key %s written to %s. Set SIGNING_KEY_ID=%s to start signing with it.\n", kid, dir, kid)
+	return nil
 }
 
 // setupCORS configures CORS settings for the router
@@ -334,31 +576,29 @@ func setupCORS(router *mux.Router) http.Handler {
 		"OPTIONS",
 	})
 
-	origins := handlers.AllowedOrigins([]string{
-		"https://cpcglobal.org",
-		"https://cdn.cpcglobal.org"})
+	origins := handlers.AllowedOrigins(allowedOrigins)
 
 	return handlers.CORS(headers, methods, origins)(router)
 }
 
-// getClientIP extracts the client's IP address from the request
+// getClientIP returns the client's IP address, as resolved by
+// clientIPMiddleware from the trusted proxies' forwarding header
 func getClientIP(r *http.Request) string {
-	clientIP := strings.Split(r.RemoteAddr, ":")[0]
-	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-		clientIP = strings.Split(forwardedFor, ",")[0]
+	if clientIP, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return clientIP
 	}
-	return clientIP
+	return resolver.resolve(r)
 }
 
 // HTTP Handlers
 func homeHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("Home handler called")
-	http.ServeFile(w, r, filepath.Join(templateDir, "index.html"))
+	http.ServeFile(w, r, filepath.Join(secondaryfunctions.ServerConfig.TemplateDir, "index.html"))
 }
 
 func verifyPageHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("Verify page handler called")
-	http.ServeFile(w, r, filepath.Join(templateDir, "verify.html"))
+	http.ServeFile(w, r, filepath.Join(secondaryfunctions.ServerConfig.TemplateDir, "verify.html"))
 }
 
 func searchPersonHandler(w http.ResponseWriter, r *http.Request) {
@@ -368,7 +608,7 @@ func searchPersonHandler(w http.ResponseWriter, r *http.Request) {
 
 	if searchTerm == "" {
 		remark := fmt.Sprintf("Request IP: %s | Empty search term in request", clientIP)
-		secondaryfunctions.LogError("invalid_request", remark)
+		secondaryfunctions.LogErrorContext(r.Context(), "invalid_request", remark)
 		sendJSONError(w, "Search term is required", http.StatusBadRequest)
 		return
 	}
@@ -379,8 +619,10 @@ func searchPersonHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	recordEvent(r, secondaryfunctions.EventSearch, person.StudentID)
+
 	// Initiate async certificate generation
-	initiateAsyncCertificateGeneration(person.StudentID, clientIP)
+	job := initiateAsyncCertificateGeneration(r.Context(), person.StudentID, clientIP)
 
 	phoneNo := person.PhoneNo
 	if len(phoneNo) > 4 {
@@ -393,6 +635,9 @@ func searchPersonHandler(w http.ResponseWriter, r *http.Request) {
 		"phone_no":         phoneNo,
 		"certificate_link": "/api/generate-certificate/" + person.StudentID,
 	}
+	if job != nil {
+		response["job_id"] = job.ID
+	}
 	sendJSONResponse(w, response, http.StatusOK)
 }
 
@@ -427,50 +672,67 @@ func generateCertificateHandler(w http.ResponseWriter, r *http.Request) {
 	if person == nil {
 		remark := fmt.Sprintf("Request IP: %s | Failed to generate certificate for student ID: %s | Student not found",
 			clientIP, studentId)
-		secondaryfunctions.LogError("certificate_generation_failure", remark)
+		secondaryfunctions.LogErrorContext(r.Context(), "certificate_generation_failure", remark)
 		sendJSONError(w, "Student not found", http.StatusNotFound)
 		return
 	}
 
-	// Check if certificate is currently being generated
-	certificateGenerationTracker.RLock()
-	if certificateGenerationTracker.inProgress[studentId] {
-		certificateGenerationTracker.RUnlock()
+	// Check if certificate is currently being generated. A queued job counts too:
+	// a worker may claim it while we render, and it will produce the file anyway.
+	job, err := secondaryfunctions.ActiveJob(studentId)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to check generation job for student: %s | Error: %v",
+			clientIP, studentId, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+	}
+	if job != nil {
 		// Return a 202 Accepted status with a message
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusAccepted)
-		json.NewEncoder(w).Encode(map[string]string{
+		json.NewEncoder(w).Encode(map[string]interface{}{
 			"message": "Certificate generation in progress, please try again in a few moments",
+			"job_id":  job.ID,
 		})
 		return
 	}
-	certificateGenerationTracker.RUnlock()
-
-	// Check if the certificate file already exists
-	certPath := filepath.Join("generated_files", studentId+".pdf")
-	if _, err := os.Stat(certPath); os.IsNotExist(err) {
-		// Certificate doesn't exist, start generation
-		certificateGenerationTracker.Lock()
-		certificateGenerationTracker.inProgress[studentId] = true
-		certificateGenerationTracker.Unlock()
 
-		// Generate certificate
-		if _, err := secondaryfunctions.GenerateCertificate(person.FullName, person.StudentID); err != nil {
-			certificateGenerationTracker.Lock()
-			delete(certificateGenerationTracker.inProgress, studentId)
-			certificateGenerationTracker.Unlock()
+	// Check if the certificate file already exists and matches the issuance on record
+	certPath, err := secondaryfunctions.CertificatePath(person.StudentID)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to locate certificate for student: %s | Error: %v",
+			clientIP, person.StudentID, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "certificate_generation_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	templateKey, err := secondaryfunctions.ResolveTemplateKey(person.StudentID)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to resolve certificate template for student: %s | Error: %v",
+			clientIP, person.StudentID, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "certificate_generation_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	current, err := secondaryfunctions.CertificateIsCurrent(person.FullName, person.StudentID, templateKey, certPath)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to check certificate record for student: %s | Error: %v",
+			clientIP, person.StudentID, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+	}
+	if !current {
+		// Certificate doesn't exist or is out of date, generate it now
+		if _, err := secondaryfunctions.GenerateCertificateWithTemplate(person.FullName, person.StudentID, templateKey); err != nil {
+			if err == secondaryfunctions.ErrCertificateRevoked {
+				sendJSONError(w, "Certificate has been revoked", http.StatusGone)
+				return
+			}
 
 			remark := fmt.Sprintf("Request IP: %s | Failed to generate certificate for student: %s | Error: %v",
 				clientIP, person.StudentID, err)
-			secondaryfunctions.LogError("certificate_generation_error", remark)
+			secondaryfunctions.LogErrorContext(r.Context(), "certificate_generation_error", remark)
 			sendJSONError(w, "Failed to generate certificate", http.StatusInternalServerError)
 			return
 		}
-
-		certificateGenerationTracker.Lock()
-		delete(certificateGenerationTracker.inProgress, studentId)
-		certificateGenerationTracker.completed[studentId] = time.Now()
-		certificateGenerationTracker.Unlock()
 	}
 
 	// Get file information
@@ -516,7 +778,8 @@ func generateCertificateHandler(w http.ResponseWriter, r *http.Request) {
 	downloadTracker.RUnlock()
 
 	if status != nil && status.Completed {
-		if err := SaveStats(person.StudentID, clientIP); err != nil {
+		certificateDownloads.Inc("complete")
+		if err := SaveStats(r, person.StudentID, downloadID); err != nil {
 			log.Printf("Error saving stats for %s: %v", person.StudentID, err)
 		}
 
@@ -525,9 +788,10 @@ func generateCertificateHandler(w http.ResponseWriter, r *http.Request) {
 			person.StudentID, downloadID)
 	} else {
 		// Log incomplete download
+		certificateDownloads.Inc("incomplete")
 		remark := fmt.Sprintf("Request IP: %s | Incomplete certificate download for student: %s | Download ID: %s",
 			clientIP, person.StudentID, downloadID)
-		secondaryfunctions.LogError("incomplete_download", remark)
+		secondaryfunctions.LogErrorContext(r.Context(), "incomplete_download", remark)
 	}
 
 	// Clean up download tracking after a delay
@@ -539,6 +803,69 @@ func generateCertificateHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 }
 
+// streamCertificateHandler renders a certificate in memory and sends it without
+// reading or writing anything in the output directory
+func streamCertificateHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	studentId := vars["studentId"]
+	clientIP := getClientIP(r)
+	log.Printf("Stream certificate handler called with student ID: %s\n", studentId)
+
+	var format certificate.Format
+	var contentType string
+	switch r.URL.Query().Get("format") {
+	case "", "pdf":
+		format, contentType = certificate.FormatPDF, "application/pdf"
+	case "jpeg":
+		format, contentType = certificate.FormatJPEG, "image/jpeg"
+	default:
+		sendJSONError(w, "Unsupported certificate format", http.StatusBadRequest)
+		return
+	}
+
+	person := secondaryfunctions.GetPerson(studentId, clientIP)
+	if person == nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to stream certificate for student ID: %s | Student not found",
+			clientIP, studentId)
+		secondaryfunctions.LogErrorContext(r.Context(), "certificate_generation_failure", remark)
+		sendJSONError(w, "Student not found", http.StatusNotFound)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := secondaryfunctions.RenderCertificate(&buf, person.FullName, person.StudentID, format); err != nil {
+		if err == secondaryfunctions.ErrCertificateRevoked {
+			sendJSONError(w, "Certificate has been revoked", http.StatusGone)
+			return
+		}
+		remark := fmt.Sprintf("Request IP: %s | Failed to stream certificate for student: %s | Error: %v",
+			clientIP, person.StudentID, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "certificate_generation_error", remark)
+		sendJSONError(w, "Failed to generate certificate", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", person.StudentID, format))
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", buf.Len()))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if _, err := buf.WriteTo(w); err != nil {
+		certificateDownloads.Inc("incomplete")
+		remark := fmt.Sprintf("Request IP: %s | Incomplete certificate stream for student: %s | Error: %v",
+			clientIP, person.StudentID, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "incomplete_download", remark)
+		return
+	}
+	certificateDownloads.Inc("complete")
+
+	if err := SaveStats(r, person.StudentID, ""); err != nil {
+		log.Printf("Error saving stats for %s: %v", person.StudentID, err)
+	}
+}
+
 // downloadResponseWriter wraps http.ResponseWriter to track download progress
 type downloadResponseWriter struct {
 	http.ResponseWriter
@@ -575,7 +902,7 @@ func verifyStudentHandler(w http.ResponseWriter, r *http.Request) {
 
 	if studentId == "" {
 		remark := fmt.Sprintf("Request IP: %s | Empty student ID in verification request", clientIP)
-		secondaryfunctions.LogError("invalid_request", remark)
+		secondaryfunctions.LogErrorContext(r.Context(), "invalid_request", remark)
 		sendJSONError(w, "Student ID is required", http.StatusBadRequest)
 		return
 	}
@@ -584,51 +911,177 @@ func verifyStudentHandler(w http.ResponseWriter, r *http.Request) {
 	if person == nil {
 		remark := fmt.Sprintf("Request IP: %s | Student not found during verification: %s",
 			clientIP, studentId)
-		secondaryfunctions.LogError("verification_failure", remark)
+		secondaryfunctions.LogErrorContext(r.Context(), "verification_failure", remark)
 		sendJSONError(w, "Student not found", http.StatusNotFound)
 		return
 	}
 
-	// Save verification record as a remark
-	verificationRemark := fmt.Sprintf("Certificate verified via Go server at %s from IP %s",
-		time.Now().Format(time.RFC3339), clientIP)
+	// Save verification event; the response goes out even if this fails
+	recordEvent(r, secondaryfunctions.EventVerify, person.StudentID)
 
-	if err := secondaryfunctions.AddRemark(studentId, verificationRemark, clientIP); err != nil {
-		remark := fmt.Sprintf("Request IP: %s | Failed to save verification record for student: %s | Error: %v",
+	issuance, err := secondaryfunctions.LatestIssuance(person.StudentID)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to fetch certificate record for student: %s | Error: %v",
 			clientIP, studentId, err)
-		secondaryfunctions.LogError("verification_record_failure", remark)
-		// Continue with the response even if logging fails
-		log.Printf("Failed to save verification record: %v", err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
 	response := map[string]interface{}{
 		"full_name": person.FullName,
 		"NID":       person.NID,
+		"status":    secondaryfunctions.IssuanceStatusNotIssued,
+	}
+	if issuance != nil {
+		public := issuance.Public()
+		response["status"] = issuance.Status
+		response["certificate"] = &public
 	}
 	sendJSONResponse(w, response, http.StatusOK)
 }
 
-func SaveStats(studentID string, clientIP string) error {
+// verifyTokenHandler checks the signed token from a certificate QR code
+func verifyTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	clientIP := getClientIP(r)
+	log.Printf("Verify token handler called\n")
+
+	if token == "" {
+		remark := fmt.Sprintf("Request IP: %s | Empty token in verification request", clientIP)
+		secondaryfunctions.LogErrorContext(r.Context(), "invalid_request", remark)
+		sendJSONError(w, "Token is required", http.StatusBadRequest)
+		return
+	}
+
+	keyring, err := secondaryfunctions.Keyring()
+	if err != nil || keyring == nil {
+		sendJSONError(w, "Signed certificates are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	claims, err := keyring.Verify(token)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Invalid certificate token | Error: %v", clientIP, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "token_verification_failure", remark)
+		sendJSONError(w, "Invalid certificate token", http.StatusBadRequest)
+		return
+	}
+
+	issuance, err := secondaryfunctions.GetIssuance(claims.Serial)
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to fetch certificate %s | Error: %v", clientIP, claims.Serial, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if issuance == nil || issuance.StudentID != claims.StudentID {
+		remark := fmt.Sprintf("Request IP: %s | Certificate %s not on record for student %s",
+			clientIP, claims.Serial, claims.StudentID)
+		secondaryfunctions.LogErrorContext(r.Context(), "verification_failure", remark)
+		sendJSONError(w, "Certificate not found", http.StatusNotFound)
+		return
+	}
+
+	// The token authenticates the student ID, so look it up exactly
+	person, err := secondaryfunctions.GetStudent(claims.StudentID)
+	if err == secondaryfunctions.ErrStudentNotFound {
+		remark := fmt.Sprintf("Request IP: %s | Student not found during token verification: %s",
+			clientIP, claims.StudentID)
+		secondaryfunctions.LogErrorContext(r.Context(), "verification_failure", remark)
+		sendJSONError(w, "Student not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to fetch student %s | Error: %v", clientIP, claims.StudentID, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	recordEvent(r, secondaryfunctions.EventVerify, person.StudentID)
+
+	public := issuance.Public()
+	response := map[string]interface{}{
+		"valid":        issuance.Status == secondaryfunctions.IssuanceStatusIssued,
+		"status":       issuance.Status,
+		"student_id":   claims.StudentID,
+		"full_name":    person.FullName,
+		"serial":       claims.Serial,
+		"issued_at":    claims.IssuedAt.Format("2006-01-02"),
+		"key_id":       claims.KeyID,
+		"name_matches": claims.MatchesName(person.FullName),
+		"certificate":  &public,
+	}
+	sendJSONResponse(w, response, http.StatusOK)
+}
+
+// publicKeysHandler publishes the keys certificate tokens can be verified with
+func publicKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keyring, err := secondaryfunctions.Keyring()
+	if err != nil || keyring == nil {
+		sendJSONError(w, "Signed certificates are not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	publicKeys := keyring.PublicKeys()
+	keys := make([]map[string]string, 0, len(publicKeys))
+	for _, kid := range keyring.KeyIDs() {
+		keys = append(keys, map[string]string{
+			"kid":        kid,
+			"alg":        "Ed25519",
+			"public_key": publicKeys[kid],
+		})
+	}
+
+	response := map[string]interface{}{
+		"active_key_id": keyring.ActiveKeyID,
+		"keys":          keys,
+	}
+	sendJSONResponse(w, response, http.StatusOK)
+}
+
+// SaveStats records a completed certificate download
+func SaveStats(r *http.Request, studentID, downloadID string) error {
+	clientIP := getClientIP(r)
 	if studentID == "" {
 		remark := fmt.Sprintf("Request IP: %s | Attempt to save stats with empty student ID", clientIP)
-		secondaryfunctions.LogError("invalid_stats_request", remark)
+		secondaryfunctions.LogErrorContext(r.Context(), "invalid_stats_request", remark)
 		return fmt.Errorf("student ID cannot be empty")
 	}
 
-	statsRemark := fmt.Sprintf("Certificate downloaded via Go server at %s from IP %s",
-		time.Now().Format(time.RFC3339), clientIP)
-
-	err := secondaryfunctions.AddRemark(studentID, statsRemark, clientIP)
+	err := secondaryfunctions.RecordEvent(newEvent(r, secondaryfunctions.EventDownload, studentID, downloadID))
 	if err != nil {
 		remark := fmt.Sprintf("Request IP: %s | Failed to save stats for student: %s | Error: %v",
 			clientIP, studentID, err)
-		secondaryfunctions.LogError("stats_save_failure", remark)
+		secondaryfunctions.LogErrorContext(r.Context(), "stats_save_failure", remark)
 		return fmt.Errorf("failed to save stats: %v", err)
 	}
 
 	return nil
 }
 
+// newEvent describes an event for a student caused by a request
+func newEvent(r *http.Request, eventType, studentID, downloadID string) secondaryfunctions.Event {
+	return secondaryfunctions.Event{
+		StudentID:  studentID,
+		Type:       eventType,
+		ClientIP:   getClientIP(r),
+		UserAgent:  r.UserAgent(),
+		DownloadID: downloadID,
+	}
+}
+
+// recordEvent stores a search or verification event for a request. Failures are
+// logged but never fail the request.
+func recordEvent(r *http.Request, eventType, studentID string) {
+	if err := secondaryfunctions.RecordEvent(newEvent(r, eventType, studentID, "")); err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to save %s event for student: %s | Error: %v",
+			getClientIP(r), eventType, studentID, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "event_record_failure", remark)
+	}
+}
+
 // Helper functions for JSON responses
 func sendJSONResponse(w http.ResponseWriter, data interface{}, status int) {
 	w.Header().Set("Content-Type", "application/json")
@@ -647,6 +1100,25 @@ func startServer() error {
 	// Register routes
 	registerRoutes(r)
 
+	config := secondaryfunctions.ServerConfig
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	limiter, err := secondaryfunctions.NewRateLimiter(config.RateLimitBackend)
+	if err != nil {
+		return err
+	}
+	trusted, err := config.TrustedProxyPrefixes()
+	if err != nil {
+		return err
+	}
+	resolver = clientIPResolver{trusted: trusted, header: http.CanonicalHeaderKey(config.ForwardedHeader)}
+
+	r.Use(clientIPMiddleware)
+	r.Use(requestIDMiddleware)
+	r.Use(metricsMiddleware)
+	r.Use(rateLimitMiddleware(limiter))
+
 	// Add CORS middleware
 	r.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -660,24 +1132,46 @@ func startServer() error {
 
 	corsHandler := setupCORS(r)
 
-	// Get SSL certificates
-	certFile := os.Getenv("CERT_FILE")
-	keyFile := os.Getenv("KEY_FILE")
-	if certFile == "" || keyFile == "" {
-		return fmt.Errorf("CERT_FILE and KEY_FILE must be defined in the .env file")
+	server := &http.Server{
+		Addr:              config.Addr,
+		Handler:           corsHandler,
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
 	}
 
 	// Log server listening status
-	listeningRemark := fmt.Sprintf("Server listening on :5000 with SSL at %s\nCertificate File: %s\nKey File: %s",
-		time.Now().Format(time.RFC3339),
-		certFile,
-		keyFile)
-	if err := secondaryfunctions.LogError("server_listening", listeningRemark); err != nil {
-		log.Printf("Failed to log server listening status: %v", err)
+	mode := "plain HTTP"
+	if config.TLS {
+		mode = fmt.Sprintf("TLS\nCertificate File: %s\nKey File: %s", config.CertFile, config.KeyFile)
 	}
+	listeningRemark := fmt.Sprintf("Server listening on %s at %s with %s", config.Addr, time.Now().Format(time.RFC3339), mode)
+	secondaryfunctions.LogError("server_listening", listeningRemark)
 
-	log.Println("Starting server on :5000 with SSL...")
-	return http.ListenAndServeTLS(":5000", certFile, keyFile, corsHandler)
+	serverErr := make(chan error, 1)
+	go func() {
+		if !config.TLS {
+			log.Printf("Starting server on %s without TLS...", config.Addr)
+			serverErr <- server.ListenAndServe()
+			return
+		}
+		log.Printf("Starting server on %s with TLS...", config.Addr)
+		serverErr <- server.ListenAndServeTLS(config.CertFile, config.KeyFile)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serverErr:
+		return err
+	case sig := <-signals:
+		// A second signal falls back to the default and stops the process at once
+		signal.Stop(signals)
+		shutdownServer(server, fmt.Sprintf("Received %v", sig))
+		return nil
+	}
 }
 
 // registerRoutes sets up all the routes for the server
@@ -686,41 +1180,74 @@ func registerRoutes(r *mux.Router) {
 	r.HandleFunc("/verify", verifyPageHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/person", searchPersonHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/generate-certificate/{studentId}", generateCertificateHandler).Methods("GET", "HEAD", "OPTIONS")
+	r.HandleFunc("/api/generate-certificate/{studentId}/stream", streamCertificateHandler).Methods("GET", "HEAD", "OPTIONS")
+	r.HandleFunc("/api/verify", verifyTokenHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/verify/{studentId}", verifyStudentHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/keys", publicKeysHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/jobs/events", jobEventStreamHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/jobs/{jobId:[0-9]+}", jobStatusHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/ws", websocketHandler)
+	r.HandleFunc("/healthz", healthzHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/readyz", readyzHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/version", versionHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/metrics", metricsHandler).Methods("GET", "HEAD")
+
+	registerAdminRoutes(r)
 }
 
 func main() {
-	// Log program startup
-	startupRemark := fmt.Sprintf("Server started at %s\nEnvironment:\n"+
-		"Template Directory: %s\n"+
-		"Certificate File: %s\n"+
-		"Key File: %s",
-		time.Now().Format(time.RFC3339),
-		templateDir,
-		os.Getenv("CERT_FILE"),
-		os.Getenv("KEY_FILE"))
-
-	if err := secondaryfunctions.LogError("server_startup", startupRemark); err != nil {
-		log.Printf("Failed to log server startup: %v", err)
+	args, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
 	}
+	config := secondaryfunctions.ServerConfig
 
 	// Handle command-line arguments if present
-	if len(os.Args) > 1 {
-		if err := handleCommandLine(); err != nil {
-			log.Fatalf("Command line error: %v", err)
+	if len(args) > 0 {
+		err := handleCommandLine(args)
+		if err != nil {
+			log.Printf("Command line error: %v", err)
+		}
+		closeLogs()
+		if err != nil {
+			os.Exit(1)
 		}
 		return
 	}
 
+	templates, err = secondaryfunctions.Templates()
+	if err != nil {
+		log.Fatalf("Error loading certificate templates: %v\n", err)
+	}
+
+	// Log program startup
+	startupRemark := fmt.Sprintf("Server started at %s\nEnvironment:\n"+
+		"Template Directory: %s\n"+
+		"Assets Directory: %s\n"+
+		"Output Directory: %s\n"+
+		"Base URL: %s",
+		time.Now().Format(time.RFC3339),
+		config.TemplateDir,
+		config.AssetsDir,
+		config.OutputDir,
+		config.BaseURL)
+
+	secondaryfunctions.LogError("server_startup", startupRemark)
+
 	// Initialize scheduled cleanup before starting the server
 	secondaryfunctions.InitScheduledCleanup(10)
 
-	// Start server if no command-line arguments
+	if err := secondaryfunctions.StartJobWorkers(secondaryfunctions.JobConfig.Workers, jobUpdated); err != nil {
+		log.Fatalf("Error starting generation workers: %v", err)
+	}
+
+	// Start server if no command was given
 	if err := startServer(); err != nil {
 		shutdownRemark := fmt.Sprintf("Server shutdown with error at %s: %v",
 			time.Now().Format(time.RFC3339), err)
-		secondaryfunctions.LogError("server_shutdown", shutdownRemark)
-		log.Fatalf("Server error: %v", err)
+		secondaryfunctions.LogEvent(context.Background(), slog.LevelError, "server_shutdown", shutdownRemark)
+		closeLogs()
+		os.Exit(1)
 	}
+	closeLogs()
 }
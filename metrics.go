@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sathimantha/goqr/secondaryfunctions"
+	"github.com/gorilla/mux"
+)
+
+var (
+	httpRequests = secondaryfunctions.NewCounterVec("goqr_http_requests_total",
+		"HTTP requests, by route, method and status code.", "route", "method", "code")
+	httpDuration = secondaryfunctions.NewHistogramVec("goqr_http_request_duration_seconds",
+		"HTTP request latency by route and method. WebSocket and event stream requests last as long as the connection.",
+		secondaryfunctions.DefaultBuckets, "route", "method")
+	certificateDownloads = secondaryfunctions.NewCounterVec("goqr_certificate_downloads_total",
+		"Certificate downloads, by result (complete or incomplete).", "result")
+	eventStreamConnections = secondaryfunctions.NewGaugeVec("goqr_event_stream_connections",
+		"Open job event connections, by transport (websocket or sse).", "transport")
+)
+
+func init() {
+	certificateDownloads.Add(0, "complete")
+	certificateDownloads.Add(0, "incomplete")
+	eventStreamConnections.Set(0, "websocket")
+	eventStreamConnections.Set(0, "sse")
+}
+
+// statusRecorder captures the status code written by a handler. It passes
+// through flushing and hijacking so event streams and WebSockets still work.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// metricsMiddleware counts and times requests by their route template, so
+// student IDs in paths don't become separate series
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		httpRequests.Inc(route, r.Method, strconv.Itoa(recorder.status))
+		httpDuration.ObserveSince(start, route, r.Method)
+	})
+}
+
+// metricsHandler serves the metrics in the Prometheus text format. When
+// METRICS_TOKEN is set the scraper must send it as a bearer token.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if expected := secondaryfunctions.AdminConfig.MetricsToken; expected != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			sendJSONError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	secondaryfunctions.WriteMetrics(w)
+}
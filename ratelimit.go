@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sathimantha/goqr/secondaryfunctions"
+	"github.com/gorilla/mux"
+)
+
+// rateLimitLogInterval is how often a rejected client or term is logged, so an
+// attacker can't flood the logs through the limiter itself
+const rateLimitLogInterval = time.Minute
+
+var rateLimited = secondaryfunctions.NewCounterVec("goqr_rate_limited_total",
+	"Requests rejected by a rate limit, by route and bucket (ip or term).", "route", "bucket")
+
+// rateLimitLogged records when each rejected bucket was last logged
+var rateLimitLogged = struct {
+	sync.Mutex
+	last      map[string]time.Time
+	lastSweep time.Time
+}{
+	last: make(map[string]time.Time),
+}
+
+// rateLimitBucket is one bucket a request takes a token from
+type rateLimitBucket struct {
+	name      string // "ip" or "term"
+	key       string
+	perMinute float64
+	burst     int
+}
+
+// rateLimitMiddleware applies the rate limit of the matched route from
+// ServerConfig.RateLimits. If the limiter's backend fails the request is let
+// through, so an outage of the shared store doesn't take the site down.
+func rateLimitMiddleware(limiter *secondaryfunctions.RateLimiter) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := ""
+			if current := mux.CurrentRoute(r); current != nil {
+				route, _ = current.GetPathTemplate()
+			}
+			limit, ok := secondaryfunctions.ServerConfig.RateLimits[route]
+			if !ok || limit.PerMinute <= 0 || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			clientIP := getClientIP(r)
+			buckets := []rateLimitBucket{{"ip", route + "|ip|" + clientIP, limit.PerMinute, limit.Burst}}
+			if limit.TermPerMinute > 0 {
+				if term := rateLimitTerm(r, limit.TermParam); term != "" {
+					buckets = append(buckets, rateLimitBucket{"term", route + "|term|" + term, limit.TermPerMinute, limit.TermBurst})
+				}
+			}
+
+			for _, bucket := range buckets {
+				allowed, retryAfter, err := limiter.Allow(bucket.key, bucket.perMinute, bucket.burst)
+				if err != nil {
+					remark := fmt.Sprintf("Request IP: %s | Rate limiter unavailable on %s | Error: %v", clientIP, route, err)
+					secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+					break
+				}
+				if !allowed {
+					rejectRateLimited(w, r, route, bucket.name, bucket.key, retryAfter)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitTerm returns the normalized value of the route's term parameter,
+// from the path variables or the query string, so trivial variations of a
+// search share a bucket
+func rateLimitTerm(r *http.Request, param string) string {
+	term, ok := mux.Vars(r)[param]
+	if !ok {
+		term = r.URL.Query().Get(param)
+	}
+	return strings.ToLower(strings.Join(strings.Fields(term), " "))
+}
+
+// rejectRateLimited answers 429 with Retry-After and logs the client, at most
+// once per rateLimitLogInterval for each bucket
+func rejectRateLimited(w http.ResponseWriter, r *http.Request, route, bucket, key string, retryAfter time.Duration) {
+	rateLimited.Inc(route, bucket)
+
+	now := time.Now()
+	rateLimitLogged.Lock()
+	shouldLog := now.Sub(rateLimitLogged.last[key]) >= rateLimitLogInterval
+	if shouldLog {
+		rateLimitLogged.last[key] = now
+	}
+	if now.Sub(rateLimitLogged.lastSweep) >= rateLimitLogInterval {
+		for k, last := range rateLimitLogged.last {
+			if now.Sub(last) >= rateLimitLogInterval {
+				delete(rateLimitLogged.last, k)
+			}
+		}
+		rateLimitLogged.lastSweep = now
+	}
+	rateLimitLogged.Unlock()
+
+	if shouldLog {
+		reason := "client IP"
+		if bucket == "term" {
+			reason = "search term"
+		}
+		remark := fmt.Sprintf("Request IP: %s | Rate limit exceeded on %s per %s | %s %s",
+			getClientIP(r), route, reason, r.Method, r.URL.Path)
+		secondaryfunctions.LogErrorContext(r.Context(), "rate_limited", remark)
+	}
+
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	sendJSONError(w, "Too many requests, please try again later", http.StatusTooManyRequests)
+}
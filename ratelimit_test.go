@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sathimantha/goqr/secondaryfunctions"
+	"github.com/gorilla/mux"
+)
+
+func TestRateLimitTerm(t *testing.T) {
+	tests := []struct {
+		name  string
+		path  string
+		query string
+		want  string
+	}{
+		{"path variable", "/api/verify/S123", "", "s123"},
+		{"query parameter", "/api/person", "search=Nimal", "nimal"},
+		{"case and spaces", "/api/person", "search=" + url.QueryEscape("  NIMAL \t  Perera "), "nimal perera"},
+		{"missing", "/api/person", "", ""},
+	}
+
+	router := mux.NewRouter()
+	var got string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		param := "search"
+		if _, ok := mux.Vars(r)["studentId"]; ok {
+			param = "studentId"
+		}
+		got = rateLimitTerm(r, param)
+	}
+	router.HandleFunc("/api/verify/{studentId}", handler)
+	router.HandleFunc("/api/person", handler)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = ""
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.path+"?"+tt.query, nil))
+			if got != tt.want {
+				t.Errorf("rateLimitTerm = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectRateLimitedRetryAfter(t *testing.T) {
+	defer secondaryfunctions.SetLogOutput(io.Discard)()
+
+	tests := []struct {
+		retryAfter time.Duration
+		want       string
+	}{
+		{0, "1"},
+		{time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{59*time.Second + time.Millisecond, "60"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/person", nil)
+		rejectRateLimited(w, r, "/api/person", "ip", "test|retry-after|"+tt.retryAfter.String(), tt.retryAfter)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("retryAfter %v: status %d, want 429", tt.retryAfter, w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != tt.want {
+			t.Errorf("retryAfter %v: Retry-After %q, want %q", tt.retryAfter, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	defer secondaryfunctions.SetLogOutput(io.Discard)()
+
+	limits := secondaryfunctions.ServerConfig.RateLimits
+	defer func() { secondaryfunctions.ServerConfig.RateLimits = limits }()
+	secondaryfunctions.ServerConfig.RateLimits = map[string]secondaryfunctions.RateLimit{
+		"/limited/{id}": {PerMinute: 60, Burst: 2, TermParam: "id", TermPerMinute: 60, TermBurst: 3},
+	}
+
+	limiter, err := secondaryfunctions.NewRateLimiter(secondaryfunctions.RateLimitMemory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	router.HandleFunc("/limited/{id}", ok).Methods("GET", "OPTIONS")
+	router.HandleFunc("/open", ok)
+	router.Use(rateLimitMiddleware(limiter))
+
+	request := func(method, path, ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	steps := []struct {
+		name   string
+		method string
+		path   string
+		ip     string
+		want   int
+	}{
+		{"first request", "GET", "/limited/S1", "192.0.2.1", http.StatusOK},
+		{"within the IP burst", "GET", "/limited/S1", "192.0.2.1", http.StatusOK},
+		{"over the IP burst", "GET", "/limited/S1", "192.0.2.1", http.StatusTooManyRequests},
+		{"preflight is not limited", "OPTIONS", "/limited/S1", "192.0.2.1", http.StatusOK},
+		{"unlimited route", "GET", "/open", "192.0.2.1", http.StatusOK},
+		{"another IP, same term within the term burst", "GET", "/limited/s1", "192.0.2.2", http.StatusOK},
+		{"term burst shared across IPs", "GET", "/limited/S1", "192.0.2.3", http.StatusTooManyRequests},
+		{"another term", "GET", "/limited/S2", "192.0.2.3", http.StatusOK},
+	}
+	for _, step := range steps {
+		w := request(step.method, step.path, step.ip)
+		if w.Code != step.want {
+			t.Errorf("%s: status %d, want %d", step.name, w.Code, step.want)
+			continue
+		}
+		if w.Code == http.StatusTooManyRequests {
+			if w.Header().Get("Retry-After") != "1" {
+				t.Errorf("%s: Retry-After %q, want \"1\"", step.name, w.Header().Get("Retry-After"))
+			}
+			if !strings.Contains(w.Body.String(), "Too many requests") {
+				t.Errorf("%s: body %q has no error message", step.name, w.Body.String())
+			}
+		}
+	}
+}
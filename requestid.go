@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/Sathimantha/goqr/secondaryfunctions"
+)
+
+// requestIDHeader carries the request ID in both directions. An ID set by a
+// proxy in front of the server is kept so its logs line up with ours.
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDMiddleware gives every request an ID, returns it in the response
+// and puts it in the request context, so every log record about the request,
+// including those of the generation job it queues, carries it
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(secondaryfunctions.WithRequestID(r.Context(), id)))
+	})
+}
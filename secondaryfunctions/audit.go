@@ -0,0 +1,102 @@
+package secondaryfunctions
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Audited admin actions
+const (
+	AuditStudentCreate     = "student.create"
+	AuditStudentUpdate     = "student.update"
+	AuditStudentDelete     = "student.delete"
+	AuditCertificateRevoke = "certificate.revoke"
+	AuditCertificateIssue  = "certificate.reissue"
+)
+
+// AuditEntry records who changed what through the admin API or CLI
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	Admin     string          `json:"admin"`
+	Action    string          `json:"action"`
+	StudentID string          `json:"student_id"`
+	Changes   json.RawMessage `json:"changes,omitempty"`
+	ClientIP  string          `json:"client_ip"`
+}
+
+// Change is the old and new value of a changed field
+type Change struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordAudit stores an audit entry, inside the caller's transaction if it has one
+func recordAudit(ex execer, admin, action, studentID, clientIP string, changes interface{}) error {
+	var changesJSON []byte
+	if changes != nil {
+		var err error
+		if changesJSON, err = json.Marshal(changes); err != nil {
+			return fmt.Errorf("error encoding audit changes: %v", err)
+		}
+	}
+
+	query := `
+		INSERT INTO audit_log (timestamp, admin, action, student_id, changes, client_ip)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+
+	_, err := ex.Exec(query, time.Now(), admin, action, studentID, changesJSON, clientIP)
+	if err != nil {
+		return fmt.Errorf("error recording audit entry: %v", err)
+	}
+	return nil
+}
+
+// RecordAudit stores an audit entry for an action that isn't otherwise recorded
+func RecordAudit(admin, action, studentID, clientIP string, changes interface{}) error {
+	return recordAudit(db, admin, action, studentID, clientIP, changes)
+}
+
+// AuditTrail returns the most recent audit entries, newest first. An empty
+// student ID returns entries for every student.
+func AuditTrail(studentID string, limit int) ([]AuditEntry, error) {
+	query := `
+		SELECT id, timestamp, admin, action, student_id, changes, COALESCE(client_ip, '')
+		FROM audit_log
+		WHERE ? = '' OR student_id = ?
+		ORDER BY timestamp DESC, id DESC
+		LIMIT ?
+	`
+
+	rows, err := db.Query(query, studentID, studentID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching audit trail: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var changes []byte
+		if err := rows.Scan(&entry.ID, &entry.Timestamp, &entry.Admin, &entry.Action, &entry.StudentID,
+			&changes, &entry.ClientIP); err != nil {
+			return nil, fmt.Errorf("error scanning audit entry: %v", err)
+		}
+		if len(changes) > 0 {
+			entry.Changes = changes
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading audit trail: %v", err)
+	}
+	return entries, nil
+}
@@ -1,43 +1,381 @@
 package secondaryfunctions
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/Sathimantha/goqr/certificate" // Adjust this import based on your structure
+	"github.com/Sathimantha/goqr/certificate"
 )
 
+// GenerateCertificate generates a certificate using the template linked to the student
 func GenerateCertificate(studentName, studentID string) (string, error) {
-	currentDir, err := filepath.Abs(".")
+	return GenerateCertificateWithTemplate(studentName, studentID, "")
+}
+
+// previewSerial is printed on previews of a certificate that hasn't been issued
+// yet; it is never on record, so a preview doesn't verify
+const previewSerial = "PREVIEW"
+
+// RenderCertificate renders a student's certificate to w without writing any
+// files. A PDF is rendered in memory first, so the student's issuance lock isn't
+// held while a slow client reads it and nothing is sent for an issuance that
+// couldn't be recorded. Other formats are previews and never issue anything.
+func RenderCertificate(w io.Writer, studentName, studentID string, format certificate.Format) (err error) {
+	start := time.Now()
+	defer func() { recordGeneration(start, err) }()
+
+	templateKey, generator, err := generatorForStudent(studentID, "")
+	if err != nil {
+		return err
+	}
+
+	if format != certificate.FormatPDF {
+		return renderPreview(w, generator, studentName, studentID, templateKey, format)
+	}
+
+	tx, err := beginIssuance(studentID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	issuance, isNew, err := prepareIssuance(tx, studentName, studentID, templateKey, false)
+	if err != nil {
+		return err
+	}
+
+	var rendered bytes.Buffer
+	if err := generator.RenderTo(&rendered, issuance.certificateData(), format); err != nil {
+		return fmt.Errorf("Error rendering certificate: %v", err)
+	}
+
+	sum := sha256.Sum256(rendered.Bytes())
+	if err := saveIssuance(tx, issuance, isNew, hex.EncodeToString(sum[:])); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing certificate %s: %v", issuance.Serial, err)
+	}
+
+	_, err = rendered.WriteTo(w)
+	return err
+}
+
+// renderPreview renders the student's current certificate in a preview format,
+// or, if a new one would be issued, a provisional one with previewSerial that
+// isn't recorded
+func renderPreview(w io.Writer, generator *certificate.Generator, studentName, studentID, templateKey string, format certificate.Format) error {
+	issuance, isNew, err := prepareIssuance(db, studentName, studentID, templateKey, false)
 	if err != nil {
-		return "", fmt.Errorf("Error getting current directory: %v", err)
+		return err
+	}
+	if isNew {
+		issuance.Serial = previewSerial
 	}
 
-	fontPath := "assets/Roboto-Regular.ttf" // Update this to the actual path of your TTF font
-	outputDir := filepath.Join(currentDir, "generated_files")
-	certificatePath := filepath.Join(outputDir, studentID+".pdf") // Assuming you name the file using studentID
+	if err := generator.RenderTo(w, issuance.certificateData(), format); err != nil {
+		return fmt.Errorf("Error rendering certificate: %v", err)
+	}
+	return nil
+}
 
-	// Check if the certificate already exists and delete it
-	if _, err := os.Stat(certificatePath); err == nil {
-		if err := os.Remove(certificatePath); err != nil {
-			return "", fmt.Errorf("Error deleting existing certificate: %v", err)
+// prepareIssuance returns the issuance a certificate should be rendered for. The
+// student's latest certificate is reprinted when it is still valid and matches
+// the current name and template; otherwise a new serial is issued that supersedes
+// it. A revoked certificate is only replaced when reissue is set, which also
+// forces a new serial. q must be the transaction from beginIssuance if the
+// issuance is going to be recorded.
+func prepareIssuance(q queryer, studentName, studentID, templateKey string, reissue bool) (*Issuance, bool, error) {
+	latest, err := latestIssuance(q, studentID)
+	if err != nil {
+		return nil, false, err
+	}
+	if latest != nil && !reissue {
+		if latest.Status == IssuanceStatusRevoked {
+			return nil, false, ErrCertificateRevoked
+		}
+		if latest.Status == IssuanceStatusIssued &&
+			latest.RenderedName == studentName && latest.TemplateKey == templateKey {
+			return latest, false, nil
 		}
-		log.Printf("Deleted existing certificate: %s\n", certificatePath)
+	}
+
+	issuedAt := time.Now().UTC().Truncate(time.Second)
+	issuance := &Issuance{
+		Serial:       newSerial(issuedAt),
+		StudentID:    studentID,
+		TemplateKey:  templateKey,
+		RenderedName: studentName,
+		IssuedAt:     issuedAt,
+		Status:       IssuanceStatusIssued,
+	}
+	if latest != nil {
+		issuance.Supersedes = latest.Serial
+	}
+	return issuance, true, nil
+}
+
+// saveIssuance records a new issuance, or refreshes the content hash of a reprinted one
+func saveIssuance(tx *sql.Tx, issuance *Issuance, isNew bool, contentHash string) error {
+	if isNew {
+		issuance.ContentHash = contentHash
+		return recordIssuance(tx, issuance)
+	}
+	if issuance.ContentHash != contentHash {
+		issuance.ContentHash = contentHash
+		return updateIssuanceHash(tx, issuance.Serial, contentHash)
+	}
+	return nil
+}
+
+// certificateData returns what gets drawn onto the certificate for an issuance
+func (i *Issuance) certificateData() certificate.CertificateData {
+	return certificate.CertificateData{
+		StudentName: i.RenderedName,
+		StudentID:   i.StudentID,
+		Serial:      i.Serial,
+		IssuedAt:    i.IssuedAt,
+	}
+}
+
+// newSerial returns a certificate serial such as CPC-20240831-9F3A61C2
+func newSerial(issuedAt time.Time) string {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		log.Printf("Error reading random bytes for serial: %v\n", err)
+	}
+	return fmt.Sprintf("CPC-%s-%s", issuedAt.Format("20060102"), strings.ToUpper(hex.EncodeToString(random)))
+}
+
+// ResolveTemplateKey returns the key of the template a student's certificate is
+// rendered with: the student's own, their latest course's, or the default
+func ResolveTemplateKey(studentID string) (string, error) {
+	templates, err := Templates()
+	if err != nil {
+		return "", fmt.Errorf("Error loading certificate templates: %v", err)
+	}
+
+	templateKey, err := GetTemplateKey(studentID)
+	if err != nil {
+		return "", err
+	}
+	if templateKey == "" {
+		templateKey = templates.DefaultKey
+	}
+	return templateKey, nil
+}
+
+// generatorForStudent returns the generator for a template key, resolving the
+// key from the student's record when it is empty
+func generatorForStudent(studentID, templateKey string) (string, *certificate.Generator, error) {
+	templates, err := Templates()
+	if err != nil {
+		return "", nil, fmt.Errorf("Error loading certificate templates: %v", err)
+	}
+
+	if templateKey == "" {
+		templateKey, err = ResolveTemplateKey(studentID)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	generator, err := templates.Generator(templateKey)
+	if err != nil {
+		return "", nil, err
+	}
+	return templateKey, generator, nil
+}
+
+// GenerateCertificateWithTemplate generates a certificate with the given template key
+// and records its issuance. An empty key resolves the template from the student's record.
+func GenerateCertificateWithTemplate(studentName, studentID, templateKey string) (string, error) {
+	path, _, err := generateCertificate(studentName, studentID, templateKey, false)
+	return path, err
+}
+
+// ReissueCertificate issues a new certificate with a new serial that supersedes the
+// student's latest one, including a revoked one, e.g. after a name correction, and
+// returns the new issuance
+func ReissueCertificate(studentName, studentID, templateKey string) (*Issuance, error) {
+	_, issuance, err := generateCertificate(studentName, studentID, templateKey, true)
+	return issuance, err
+}
+
+// RevokeCertificate revokes a certificate and, if it was the student's current
+// one, removes its cached PDF. An empty serial revokes the student's latest
+// certificate. It returns ErrCertificateNotFound if the certificate isn't on
+// record for the student and ErrCertificateAlreadyRevoked if it is revoked.
+// It holds the student's issuance lock, so the latest certificate can't be
+// superseded between looking it up and revoking it.
+func RevokeCertificate(studentID, serial, reason, revokedBy string) (*Issuance, error) {
+	tx, err := beginIssuance(studentID)
+	if err == ErrStudentNotFound {
+		return nil, ErrCertificateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var target *Issuance
+	if serial == "" {
+		target, err = latestIssuance(tx, studentID)
+	} else {
+		target, err = getIssuance(tx, serial)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if target == nil || target.StudentID != studentID {
+		return nil, ErrCertificateNotFound
+	}
+	if target.Status == IssuanceStatusRevoked {
+		return nil, ErrCertificateAlreadyRevoked
+	}
+	serial = target.Serial
+
+	if err := revokeIssuance(tx, serial, reason, revokedBy); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing revocation of certificate %s: %v", serial, err)
+	}
+
+	if target.Status == IssuanceStatusIssued {
+		removeCachedCertificate(studentID)
+	}
+
+	log.Printf("Certificate %s for student %s revoked by %s: %s\n", serial, studentID, revokedBy, reason)
+	return GetIssuance(serial)
+}
+
+// CertificatePath returns where a student's generated PDF is kept
+func CertificatePath(studentID string) (string, error) {
+	templates, err := Templates()
+	if err != nil {
+		return "", fmt.Errorf("Error loading certificate templates: %v", err)
+	}
+	generator, err := templates.Generator("")
+	if err != nil {
+		return "", fmt.Errorf("Error loading default template: %v", err)
+	}
+	return filepath.Join(generator.OutputDir, studentID+".pdf"), nil
+}
+
+// removeCachedCertificate deletes a student's PDF from the output directory so
+// the next download renders it again
+func removeCachedCertificate(studentID string) {
+	certificatePath, err := CertificatePath(studentID)
+	if err != nil {
+		log.Printf("%v\n", err)
+		return
+	}
+
+	if err := os.Remove(certificatePath); err == nil {
+		log.Printf("Deleted cached certificate: %s\n", certificatePath)
 	} else if !os.IsNotExist(err) {
-		return "", fmt.Errorf("Error checking for existing certificate: %v", err)
+		log.Printf("Error deleting cached certificate %s: %v\n", certificatePath, err)
+	}
+}
+
+func generateCertificate(studentName, studentID, templateKey string, reissue bool) (path string, issuance *Issuance, err error) {
+	start := time.Now()
+	defer func() { recordGeneration(start, err) }()
+
+	templateKey, generator, err := generatorForStudent(studentID, templateKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tx, err := beginIssuance(studentID)
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback()
+
+	var isNew bool
+	issuance, isNew, err = prepareIssuance(tx, studentName, studentID, templateKey, reissue)
+	if err != nil {
+		return "", nil, err
 	}
 
-	// Initialize the certificate generator
-	generator := certificate.NewGenerator(currentDir, outputDir, fontPath)
+	// Render to a temporary file and only move it over the previous certificate
+	// once its issuance is on record: a certificate whose serial isn't on record
+	// would fail verification, and the previous one is still valid
+	staged, err := generator.StageCertificate(issuance.certificateData())
+	if err != nil {
+		return "", nil, fmt.Errorf("Error generating certificate: %v", err)
+	}
+	defer staged.Discard()
 
-	// Generate the certificate
-	path, err := generator.GenerateCertificate(studentName, studentID)
+	contentHash, err := hashFile(staged.TempPath)
 	if err != nil {
-		return "", fmt.Errorf("Error generating certificate: %v", err)
+		return "", nil, err
+	}
+	if err := saveIssuance(tx, issuance, isNew, contentHash); err != nil {
+		return "", nil, err
 	}
+	if err := tx.Commit(); err != nil {
+		return "", nil, fmt.Errorf("error committing certificate %s: %v", issuance.Serial, err)
+	}
+
+	// If this fails the file no longer matches the hash on record, so the next
+	// download renders it again with the same serial
+	if err := staged.Commit(); err != nil {
+		return "", nil, err
+	}
+	path = staged.Path
 
-	log.Printf("Certificate saved at: %s\n", path)
-	return path, nil
+	log.Printf("Certificate %s saved at: %s (template: %s)\n", issuance.Serial, path, templateKey)
+	return path, issuance, nil
+}
+
+// CertificateIsCurrent reports whether the certificate file at path is the one on
+// record as the student's latest valid issuance under their current name and
+// the template resolved for them now
+func CertificateIsCurrent(studentName, studentID, templateKey, path string) (bool, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	latest, err := LatestIssuance(studentID)
+	if err != nil {
+		return false, err
+	}
+	if latest == nil || latest.Status != IssuanceStatusIssued ||
+		latest.RenderedName != studentName || latest.TemplateKey != templateKey {
+		return false, nil
+	}
+
+	contentHash, err := hashFile(path)
+	if err != nil {
+		return false, err
+	}
+	return contentHash == latest.ContentHash, nil
+}
+
+// hashFile returns the hex SHA-256 of a file's contents
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Error opening certificate for hashing: %v", err)
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", fmt.Errorf("Error hashing certificate: %v", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
 }
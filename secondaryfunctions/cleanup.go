@@ -9,11 +9,14 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
-	"regexp"
+	"strings"
 	"time"
+
+	"github.com/Sathimantha/goqr/certificate"
 )
 
-var datePattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2}`)
+// staleTempAge is how old a partly written PDF must be before cleanup removes it
+const staleTempAge = time.Hour
 
 type CleanupStats struct {
 	FilesScanned   int
@@ -33,7 +36,7 @@ func CleanupOldFiles(daysOld int) error {
 	}
 
 	// Directory path for generated files
-	generatedFilesDir := "generated_files"
+	generatedFilesDir := ServerConfig.OutputDir
 
 	// Read all files in the directory
 	files, err := os.ReadDir(generatedFilesDir)
@@ -42,62 +45,39 @@ func CleanupOldFiles(daysOld int) error {
 		return fmt.Errorf("error reading directory: %v", err)
 	}
 
-	// Query to get all students with remarks
-	query := `SELECT student_id, remark FROM students WHERE remark IS NOT NULL AND remark != ''`
+	stats.FilesScanned = len(files)
 
-	rows, err := db.Query(query)
+	// Keep the certificates of students who searched, verified or downloaded recently
+	cutoff := time.Now().AddDate(0, 0, -daysOld)
+	activeStudents, err := ActiveStudentsSince(cutoff)
 	if err != nil {
 		logCleanupError("Database query failed", err, stats)
 		return fmt.Errorf("error querying database: %v", err)
 	}
-	defer rows.Close()
 
-	currentTime := time.Now()
 	remainingFiles := []string{}
 	preservedFiles := make(map[string]bool)
+	for studentID := range activeStudents {
+		preservedFiles[filepath.Join(generatedFilesDir, studentID+".pdf")] = true
+	}
 
-	// Mark files to preserve based on database remarks
-	for rows.Next() {
-		var studentID, remark string
-		if err := rows.Scan(&studentID, &remark); err != nil {
-			stats.ErrorCount++
-			log.Printf("Error scanning row: %v", err)
-			continue
-		}
-
-		// Find all dates in the remark
-		dates := datePattern.FindAllString(remark, -1)
-		if len(dates) == 0 {
-			continue
-		}
-
-		// Parse the most recent date
-		var mostRecent time.Time
-		for _, dateStr := range dates {
-			date, err := time.Parse("2006-01-02", dateStr)
-			if err != nil {
-				continue
-			}
-			if date.After(mostRecent) {
-				mostRecent = date
+	// Process all files in the directory
+	for _, file := range files {
+		// Temporary files left behind by an interrupted generation
+		if !file.IsDir() && strings.HasSuffix(file.Name(), certificate.TempSuffix) {
+			filePath := filepath.Join(generatedFilesDir, file.Name())
+			if info, err := file.Info(); err == nil && time.Since(info.ModTime()) > staleTempAge {
+				if err := os.Remove(filePath); err != nil {
+					stats.ErrorCount++
+					log.Printf("Error deleting stale temporary file %s: %v", filePath, err)
+				} else {
+					stats.FilesDeleted++
+					log.Printf("Deleted stale temporary file: %s", filePath)
+				}
 			}
-		}
-
-		// If we found no valid dates, skip this record
-		if mostRecent.IsZero() {
 			continue
 		}
 
-		certPath := filepath.Join(generatedFilesDir, studentID+".pdf")
-
-		// If file is older than specified days, preserve it
-		if currentTime.Sub(mostRecent).Hours() <= float64(daysOld*24) {
-			preservedFiles[certPath] = true
-		}
-	}
-
-	// Process all files in the directory
-	for _, file := range files {
 		if !file.IsDir() && filepath.Ext(file.Name()) == ".pdf" {
 			filePath := filepath.Join(generatedFilesDir, file.Name())
 
@@ -140,6 +120,34 @@ func CleanupOldFiles(daysOld int) error {
 		}
 	}
 
+	// Finished generation jobs are only kept as long as the files
+	if purged, err := PurgeJobs(cutoff); err != nil {
+		stats.ErrorCount++
+		log.Printf("Error purging generation jobs: %v", err)
+	} else if purged > 0 {
+		log.Printf("Purged %d finished generation jobs", purged)
+	}
+
+	// Shared rate limit buckets that filled up again are the same as missing ones
+	if ServerConfig.RateLimitBackend == RateLimitMySQL {
+		if pruned, err := PruneRateLimits(); err != nil {
+			stats.ErrorCount++
+			log.Printf("Error pruning rate limit buckets: %v", err)
+		} else if pruned > 0 {
+			log.Printf("Pruned %d rate limit buckets", pruned)
+		}
+	}
+
+	// Logged events are kept for their own retention period
+	if LogConfig.Retention > 0 {
+		if pruned, err := PruneLogs(time.Now().Add(-LogConfig.Retention)); err != nil {
+			stats.ErrorCount++
+			log.Printf("Error pruning logs: %v", err)
+		} else if pruned > 0 {
+			log.Printf("Pruned %d log entries older than %v", pruned, LogConfig.Retention)
+		}
+	}
+
 	stats.Duration = time.Since(stats.StartTime)
 	logCleanupSuccess(daysOld, stats)
 
@@ -155,6 +163,7 @@ func logCleanupError(message string, err error, stats *CleanupStats) {
 		stats.ErrorCount, time.Since(stats.StartTime))
 
 	LogError("cleanup_error", errorRemark)
+	recordCleanup(stats, "error")
 }
 
 // logCleanupSuccess logs successful cleanup operations to the errors table
@@ -178,6 +187,7 @@ func logCleanupSuccess(daysOld int, stats *CleanupStats) {
 		stats.NewestFileDate.Format("2006-01-02"))
 
 	LogError("cleanup_success", successRemark)
+	recordCleanup(stats, "success")
 }
 
 // InitScheduledCleanup starts the cleanup scheduler
@@ -1,8 +1,16 @@
 package secondaryfunctions
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
+	"net/netip"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -16,12 +24,280 @@ var DBConfig struct {
 	Database string
 }
 
+// SigningConfig holds the certificate signing key settings. Without an active
+// key ID certificates carry an unsigned QR code.
+var SigningConfig struct {
+	KeysDir     string
+	ActiveKeyID string
+}
+
+// AdminConfig holds the bearer tokens accepted by the admin API, mapped to the
+// name of the staff member each one belongs to
+var AdminConfig struct {
+	Tokens       map[string]string
+	MetricsToken string // bearer token required by /metrics; open when empty
+}
+
+// JobConfig holds the settings of the certificate generation queue
+var JobConfig struct {
+	Workers      int           // number of certificates the server generates at once
+	MaxAttempts  int           // runs before a job is marked failed
+	RetryBackoff time.Duration // delay before the first retry, doubled for each further one
+	MaxQueued    int           // queued jobs above which the server reports itself not ready
+}
+
+// ServerSettings configures the HTTP server and where files are read and written
+type ServerSettings struct {
+	Addr              string        `json:"addr"`
+	TLS               bool          `json:"tls"` // terminate TLS here; disable behind a TLS-terminating proxy
+	CertFile          string        `json:"cert_file"`
+	KeyFile           string        `json:"key_file"`
+	ReadTimeout       time.Duration `json:"-"`
+	ReadHeaderTimeout time.Duration `json:"-"`
+	WriteTimeout      time.Duration `json:"-"`
+	IdleTimeout       time.Duration `json:"-"`
+	ShutdownTimeout   time.Duration `json:"-"` // how long a stopping server waits for requests and jobs
+	MaxHeaderBytes    int           `json:"max_header_bytes"`
+	TemplateDir       string        `json:"template_dir"` // HTML pages
+	AssetsDir         string        `json:"assets_dir"`   // certificate templates, layouts and fonts
+	OutputDir         string        `json:"output_dir"`   // generated certificates
+	BaseURL           string        `json:"base_url"`     // public address of the site, used in QR codes and links
+	// RateLimits maps route templates such as "/api/person" to their limits;
+	// a file entry replaces the default for that route
+	RateLimits       map[string]RateLimit `json:"rate_limits"`
+	RateLimitBackend string               `json:"rate_limit_backend"` // "memory", or "mysql" to share limits between instances
+	// TrustedProxies are the addresses or CIDRs of the proxies whose
+	// ForwardedHeader is believed: X-Forwarded-For, Forwarded or X-Real-IP
+	TrustedProxies  []string `json:"trusted_proxies"`
+	ForwardedHeader string   `json:"forwarded_header"`
+}
+
+// RateLimit is a token bucket per client IP: Burst requests at once, refilled
+// at PerMinute a minute. With TermPerMinute set, each value of the TermParam
+// query parameter or path variable also gets a bucket shared by all clients.
+// A PerMinute of 0 turns the limit off.
+type RateLimit struct {
+	PerMinute     float64 `json:"per_minute"`
+	Burst         int     `json:"burst"`
+	TermParam     string  `json:"term_param,omitempty"`
+	TermPerMinute float64 `json:"term_per_minute,omitempty"`
+	TermBurst     int     `json:"term_burst,omitempty"`
+}
+
+// ServerConfig holds the server settings, see LoadServerConfig
+var ServerConfig = ServerSettings{
+	Addr:              ":5000",
+	TLS:               true,
+	ReadTimeout:       30 * time.Second,
+	ReadHeaderTimeout: 10 * time.Second,
+	WriteTimeout:      60 * time.Second,
+	IdleTimeout:       120 * time.Second,
+	ShutdownTimeout:   30 * time.Second,
+	MaxHeaderBytes:    1 << 20,
+	TemplateDir:       "templates",
+	AssetsDir:         "assets",
+	OutputDir:         "generated_files",
+	BaseURL:           "https://cpcglobal.org",
+	RateLimits: map[string]RateLimit{
+		"/api/person":             {PerMinute: 30, Burst: 20, TermParam: "search", TermPerMinute: 10, TermBurst: 5},
+		"/api/verify":             {PerMinute: 60, Burst: 30},
+		"/api/verify/{studentId}": {PerMinute: 60, Burst: 30, TermParam: "studentId", TermPerMinute: 20, TermBurst: 10},
+	},
+	RateLimitBackend: RateLimitMemory,
+	TrustedProxies:   []string{"127.0.0.0/8", "::1/128"},
+	ForwardedHeader:  "X-Forwarded-For",
+}
+
+// forwardedHeaders are the headers a trusted proxy can pass the client IP in
+var forwardedHeaders = []string{"X-Forwarded-For", "Forwarded", "X-Real-Ip"}
+
+// UnmarshalJSON reads the timeouts as duration strings such as "30s"
+func (s *ServerSettings) UnmarshalJSON(data []byte) error {
+	type settings ServerSettings
+	file := struct {
+		*settings
+		ReadTimeout       string `json:"read_timeout"`
+		ReadHeaderTimeout string `json:"read_header_timeout"`
+		WriteTimeout      string `json:"write_timeout"`
+		IdleTimeout       string `json:"idle_timeout"`
+		ShutdownTimeout   string `json:"shutdown_timeout"`
+	}{settings: (*settings)(s)}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+
+	durations := []struct {
+		name   string
+		value  string
+		target *time.Duration
+	}{
+		{"read_timeout", file.ReadTimeout, &s.ReadTimeout},
+		{"read_header_timeout", file.ReadHeaderTimeout, &s.ReadHeaderTimeout},
+		{"write_timeout", file.WriteTimeout, &s.WriteTimeout},
+		{"idle_timeout", file.IdleTimeout, &s.IdleTimeout},
+		{"shutdown_timeout", file.ShutdownTimeout, &s.ShutdownTimeout},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", d.name, d.value, err)
+		}
+		*d.target = duration
+	}
+	return nil
+}
+
+// LoadServerConfig applies a JSON config file and then environment variables
+// over the defaults in ServerConfig; command line flags are applied by the
+// caller afterwards. A missing file is only an error if required is set.
+func LoadServerConfig(path string, required bool) error {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && (required || !os.IsNotExist(err)) {
+			return fmt.Errorf("error reading config file: %v", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &ServerConfig); err != nil {
+				return fmt.Errorf("error parsing config file %s: %v", path, err)
+			}
+		}
+	}
+
+	values := map[string]*string{
+		"LISTEN_ADDR":        &ServerConfig.Addr,
+		"CERT_FILE":          &ServerConfig.CertFile,
+		"KEY_FILE":           &ServerConfig.KeyFile,
+		"TEMPLATE_DIR":       &ServerConfig.TemplateDir,
+		"ASSETS_DIR":         &ServerConfig.AssetsDir,
+		"OUTPUT_DIR":         &ServerConfig.OutputDir,
+		"BASE_URL":           &ServerConfig.BaseURL,
+		"RATE_LIMIT_BACKEND": &ServerConfig.RateLimitBackend,
+	}
+	for name, target := range values {
+		if value := os.Getenv(name); value != "" {
+			*target = value
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"READ_TIMEOUT":        &ServerConfig.ReadTimeout,
+		"READ_HEADER_TIMEOUT": &ServerConfig.ReadHeaderTimeout,
+		"WRITE_TIMEOUT":       &ServerConfig.WriteTimeout,
+		"IDLE_TIMEOUT":        &ServerConfig.IdleTimeout,
+		"SHUTDOWN_TIMEOUT":    &ServerConfig.ShutdownTimeout,
+	}
+	for name, target := range durations {
+		if value := os.Getenv(name); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %v", name, value, err)
+			}
+			*target = duration
+		}
+	}
+
+	// TRUSTED_PROXIES is a comma separated list, or "none" to trust no proxy
+	if value := os.Getenv("TRUSTED_PROXIES"); value != "" {
+		ServerConfig.TrustedProxies = nil
+		for _, proxy := range strings.Split(value, ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" && !strings.EqualFold(proxy, "none") {
+				ServerConfig.TrustedProxies = append(ServerConfig.TrustedProxies, proxy)
+			}
+		}
+	}
+	if value := os.Getenv("FORWARDED_HEADER"); value != "" {
+		ServerConfig.ForwardedHeader = value
+	}
+
+	if value := os.Getenv("SERVER_TLS"); value != "" {
+		tls, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid SERVER_TLS %q: %v", value, err)
+		}
+		ServerConfig.TLS = tls
+	}
+	if value := os.Getenv("MAX_HEADER_BYTES"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid MAX_HEADER_BYTES %q: %v", value, err)
+		}
+		ServerConfig.MaxHeaderBytes = n
+	}
+	return nil
+}
+
+// Validate checks that the settings can be used to start the server
+func (s *ServerSettings) Validate() error {
+	if s.Addr == "" {
+		return fmt.Errorf("listen address is required")
+	}
+	if s.TLS && (s.CertFile == "" || s.KeyFile == "") {
+		return fmt.Errorf("TLS needs a certificate and key file (CERT_FILE and KEY_FILE), or disable it with SERVER_TLS=false")
+	}
+	if s.MaxHeaderBytes < 1 {
+		return fmt.Errorf("max header bytes must be positive")
+	}
+	for name, d := range map[string]time.Duration{"read": s.ReadTimeout, "read header": s.ReadHeaderTimeout,
+		"write": s.WriteTimeout, "idle": s.IdleTimeout, "shutdown": s.ShutdownTimeout} {
+		if d < 0 {
+			return fmt.Errorf("%s timeout cannot be negative", name)
+		}
+	}
+	if _, err := s.TrustedProxyPrefixes(); err != nil {
+		return err
+	}
+	if !slices.Contains(forwardedHeaders, http.CanonicalHeaderKey(s.ForwardedHeader)) {
+		return fmt.Errorf("forwarded header must be one of %s", strings.Join(forwardedHeaders, ", "))
+	}
+	if s.RateLimitBackend != RateLimitMemory && s.RateLimitBackend != RateLimitMySQL {
+		return fmt.Errorf("rate limit backend must be %s or %s", RateLimitMemory, RateLimitMySQL)
+	}
+	for route, limit := range s.RateLimits {
+		if limit.PerMinute < 0 || limit.TermPerMinute < 0 {
+			return fmt.Errorf("rate limit for %s cannot be negative", route)
+		}
+		if limit.PerMinute > 0 && limit.Burst < 1 {
+			return fmt.Errorf("rate limit for %s needs a burst of at least 1", route)
+		}
+		if limit.TermPerMinute > 0 && (limit.TermBurst < 1 || limit.TermParam == "") {
+			return fmt.Errorf("term rate limit for %s needs a term_param and a term_burst of at least 1", route)
+		}
+	}
+	return nil
+}
+
+// TrustedProxyPrefixes parses TrustedProxies. A bare address is a prefix
+// covering only that address.
+func (s *ServerSettings) TrustedProxyPrefixes() ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(s.TrustedProxies))
+	for _, proxy := range s.TrustedProxies {
+		if strings.Contains(proxy, "/") {
+			prefix, err := netip.ParsePrefix(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %v", proxy, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", proxy, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
 func init() {
-	// Load the .env file
-	err := godotenv.Load()
-	if err != nil {
+	// Load the .env file; without one the settings come from the environment alone
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
+	initLogging()
 
 	// Assign environment variables to DBConfig
 	DBConfig = struct {
@@ -37,4 +313,51 @@ func init() {
 		Port:     os.Getenv("DB_PORT"),
 		Database: os.Getenv("DB_NAME"),
 	}
+
+	SigningConfig.KeysDir = os.Getenv("SIGNING_KEYS_DIR")
+	if SigningConfig.KeysDir == "" {
+		SigningConfig.KeysDir = "keys"
+	}
+	SigningConfig.ActiveKeyID = os.Getenv("SIGNING_KEY_ID")
+
+	// ADMIN_TOKENS is a comma separated list of name:token pairs
+	AdminConfig.Tokens = make(map[string]string)
+	for _, entry := range strings.Split(os.Getenv("ADMIN_TOKENS"), ",") {
+		name, token, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found || name == "" || token == "" {
+			if entry != "" {
+				log.Printf("Ignoring malformed ADMIN_TOKENS entry for %q\n", name)
+			}
+			continue
+		}
+		AdminConfig.Tokens[token] = name
+	}
+
+	AdminConfig.MetricsToken = os.Getenv("METRICS_TOKEN")
+
+	JobConfig.Workers = envInt("GENERATION_WORKERS", 2)
+	JobConfig.MaxAttempts = envInt("JOB_MAX_ATTEMPTS", 3)
+	JobConfig.MaxQueued = envInt("JOB_MAX_QUEUED", 1000)
+	JobConfig.RetryBackoff = 30 * time.Second
+	if value := os.Getenv("JOB_RETRY_BACKOFF"); value != "" {
+		if backoff, err := time.ParseDuration(value); err == nil && backoff > 0 {
+			JobConfig.RetryBackoff = backoff
+		} else {
+			log.Printf("Ignoring invalid JOB_RETRY_BACKOFF %q\n", value)
+		}
+	}
+}
+
+// envInt reads a positive integer environment variable, falling back to defaultValue
+func envInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		log.Printf("Ignoring invalid %s %q\n", name, value)
+		return defaultValue
+	}
+	return n
 }
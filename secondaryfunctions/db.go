@@ -1,9 +1,11 @@
 package secondaryfunctions
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"log/slog"
 	"regexp"
 	"time"
 
@@ -17,69 +19,59 @@ var ValidationPatterns = struct {
 	StudentID *regexp.Regexp
 	Name      *regexp.Regexp
 	NID       *regexp.Regexp
+	PhoneNo   *regexp.Regexp
 }{
 	StudentID: regexp.MustCompile(`^[A-Z0-9]{1,10}$`),
 	Name:      regexp.MustCompile(`^[^;'\\"#]{1,150}$`),
 	NID:       regexp.MustCompile(`^[^;'\\"#]{5,30}$`),
+	PhoneNo:   regexp.MustCompile(`^\+?[0-9 ()-]{5,20}$`),
 }
 
+// dbPingTimeout bounds the startup and readiness database checks
+const dbPingTimeout = 5 * time.Second
+
 func init() {
 	var err error
-	dsn := DBConfig.Username + ":" + DBConfig.Password + "@tcp(" + DBConfig.Host + ":" + DBConfig.Port + ")/" + DBConfig.Database
+	dsn := DBConfig.Username + ":" + DBConfig.Password + "@tcp(" + DBConfig.Host + ":" + DBConfig.Port + ")/" + DBConfig.Database + "?parseTime=true"
 	log.Println("Connecting to the database...")
 	db, err = sql.Open("mysql", dsn)
 	if err != nil {
+		// Only an invalid DSN gets here; sql.Open doesn't connect
 		log.Fatalf("Error connecting to the database: %v", err)
 	}
 
-	if err = db.Ping(); err != nil {
-		log.Fatalf("Database is unreachable: %v", err)
+	// An unreachable database isn't fatal: connections are retried on use and
+	// /readyz reports it until it comes back
+	if err := PingDB(context.Background()); err != nil {
+		slog.Warn("Database is unreachable", "error", err)
+		return
 	}
 
 	log.Println("Database connection established successfully.")
 }
 
-// Person represents the student object in the database
-type Person struct {
-	StudentID string
-	FullName  string
-	NID       string
-	PhoneNo   string
-	Remark    string
+// PingDB checks that the database can be reached
+func PingDB(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, dbPingTimeout)
+	defer cancel()
+	return db.PingContext(ctx)
 }
 
-// LogError logs any type of error to the errors table
-func LogError(errorType string, remark string) error {
-	query := `
-        INSERT INTO errors (
-            timestamp, 
-            error_type, 
-            remark
-        ) VALUES (?, ?, ?)
-    `
-
-	_, err := db.Exec(
-		query,
-		time.Now(),
-		errorType,
-		remark,
-	)
-
-	if err != nil {
-		log.Printf("Error logging to errors table: %v\n", err)
-		return err
-	}
-
-	return nil
+// Person represents the student object in the database
+type Person struct {
+	StudentID   string `json:"student_id"`
+	FullName    string `json:"full_name"`
+	NID         string `json:"NID"`
+	PhoneNo     string `json:"phone_no"`
+	Remark      string `json:"-"`
+	TemplateKey string `json:"template_key"`
 }
 
 func isValidSearchTerm(term, requestIP string) bool {
 	// Check if term is empty or exceeds length limit
 	if term == "" || len(term) > 150 {
 		remark := fmt.Sprintf("Request IP: %s | Empty or oversized search term received: %s", requestIP, term)
-		if err := LogError("validation_failure", remark); err != nil {
-			log.Printf("Failed to log error: %v\n", err)
-		}
+		LogError("validation_failure", remark)
 		return false
 	}
 
@@ -89,9 +81,7 @@ func isValidSearchTerm(term, requestIP string) bool {
 	// Check if the term is blank after cleanup
 	if cleanedTerm == "" {
 		remark := fmt.Sprintf("Request IP: %s | Search term resulted in blank after cleanup: %s", requestIP, term)
-		if err := LogError("validation_failure", remark); err != nil {
-			log.Printf("Failed to log error: %v\n", err)
-		}
+		LogError("validation_failure", remark)
 		return false
 	}
 
@@ -102,9 +92,7 @@ func isValidSearchTerm(term, requestIP string) bool {
 
 	if !isValid {
 		remark := fmt.Sprintf("Request IP: %s | Invalid search term pattern: %s", requestIP, term)
-		if err := LogError("validation_failure", remark); err != nil {
-			log.Printf("Failed to log error: %v\n", err)
-		}
+		LogError("validation_failure", remark)
 	}
 
 	return isValid
@@ -119,7 +107,7 @@ func GetPerson(searchTerm, requestIP string) *Person {
 	}
 
 	query := `
-			SELECT student_id, full_name, NID, phone_no, remark
+			SELECT student_id, full_name, NID, phone_no, remark, COALESCE(template_key, '')
 			FROM students
 			WHERE student_id = ?
 				OR LOWER(REGEXP_REPLACE(full_name, '[^A-Za-z0-9]', '')) = 
@@ -135,7 +123,7 @@ func GetPerson(searchTerm, requestIP string) *Person {
 	row := db.QueryRow(query, searchTerm, searchTerm, searchTerm, searchTerm)
 
 	var person Person
-	if err := row.Scan(&person.StudentID, &person.FullName, &person.NID, &person.PhoneNo, &person.Remark); err != nil {
+	if err := row.Scan(&person.StudentID, &person.FullName, &person.NID, &person.PhoneNo, &person.Remark, &person.TemplateKey); err != nil {
 		if err == sql.ErrNoRows {
 			remark := fmt.Sprintf("Request IP: %s | No matching record found for search term: %s", requestIP, searchTerm)
 			LogError("record_not_found", remark)
@@ -149,36 +137,3 @@ func GetPerson(searchTerm, requestIP string) *Person {
 
 	return &person
 }
-
-func AddRemark(studentID, newRemark, requestIP string) error {
-	var currentRemark string
-	query := `SELECT remark FROM students WHERE student_id = ?`
-	err := db.QueryRow(query, studentID).Scan(&currentRemark)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			remark := fmt.Sprintf("Request IP: %s | Student not found when adding remark: %s",
-				requestIP, studentID)
-			LogError("student_not_found", remark)
-			return fmt.Errorf("student not found")
-		}
-		remark := fmt.Sprintf("Request IP: %s | Database error while fetching current remark for student: %s | Error: %v",
-			requestIP, studentID, err)
-		LogError("database_error", remark)
-		return err
-	}
-
-	timestamp := time.Now().Format(time.RFC3339)
-	updatedRemark := fmt.Sprintf("%s\n%s - %s", currentRemark, timestamp, newRemark)
-
-	updateQuery := `UPDATE students SET remark = ? WHERE student_id = ?`
-	_, err = db.Exec(updateQuery, updatedRemark, studentID)
-	if err != nil {
-		remark := fmt.Sprintf("Request IP: %s | Error updating remark for student: %s | Error: %v",
-			requestIP, studentID, err)
-		LogError("database_error", remark)
-		return err
-	}
-
-	log.Printf("Remark updated for student %s\n", studentID)
-	return nil
-}
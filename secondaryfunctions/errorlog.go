@@ -0,0 +1,182 @@
+package secondaryfunctions
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogEntry is a row of the errors table
+type LogEntry struct {
+	ID        int64     `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Type      string    `json:"error_type"`
+	Remark    string    `json:"remark"`
+}
+
+// LogFilter selects rows of the errors table. Zero fields match every row.
+type LogFilter struct {
+	Types   []string
+	From    time.Time // inclusive
+	To      time.Time // exclusive
+	IP      string    // client IP from the "Request IP: <ip> |" prefix of the remark
+	AfterID int64     // only rows added after this one, for following new rows
+	Limit   int       // only the most recent rows
+}
+
+// where builds the WHERE clause for the filter. Every condition can use the
+// primary key or the idx_error_type and idx_timestamp indexes except the IP,
+// which is matched on the remark within the rows they select.
+func (f LogFilter) where() (string, []interface{}) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+
+	if len(f.Types) > 0 {
+		conditions = append(conditions, "error_type IN (?"+strings.Repeat(", ?", len(f.Types)-1)+")")
+		for _, t := range f.Types {
+			args = append(args, t)
+		}
+	}
+	if !f.From.IsZero() {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		conditions = append(conditions, "timestamp < ?")
+		args = append(args, f.To)
+	}
+	if f.IP != "" {
+		conditions = append(conditions, "remark LIKE ?")
+		args = append(args, "Request IP: "+escapeLike(f.IP)+" |%")
+	}
+	if f.AfterID > 0 {
+		conditions = append(conditions, "id > ?")
+		args = append(args, f.AfterID)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// QueryLogs returns the rows matching the filter, oldest first
+func QueryLogs(filter LogFilter) ([]LogEntry, error) {
+	where, args := filter.where()
+	query := `SELECT id, timestamp, error_type, COALESCE(remark, '') FROM errors WHERE ` + where + ` ORDER BY id`
+	if filter.Limit > 0 {
+		// The most recent rows, put back in order
+		query = `SELECT * FROM (SELECT id, timestamp, error_type, COALESCE(remark, '') AS remark FROM errors
+			WHERE ` + where + ` ORDER BY id DESC LIMIT ?) recent ORDER BY id`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying logs: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []LogEntry
+	for rows.Next() {
+		var entry LogEntry
+		if err := rows.Scan(&entry.ID, &entry.Timestamp, &entry.Type, &entry.Remark); err != nil {
+			return nil, fmt.Errorf("error scanning log entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading logs: %v", err)
+	}
+	return entries, nil
+}
+
+// LogCount is the number of rows of one type logged on one day
+type LogCount struct {
+	Day   string `json:"day"` // YYYY-MM-DD
+	Type  string `json:"error_type"`
+	Count int    `json:"count"`
+}
+
+// SummarizeLogs counts the rows matching the filter per day and type
+func SummarizeLogs(filter LogFilter) ([]LogCount, error) {
+	where, args := filter.where()
+	query := `
+		SELECT DATE_FORMAT(timestamp, '%Y-%m-%d') AS day, error_type, COUNT(*)
+		FROM errors
+		WHERE ` + where + `
+		GROUP BY day, error_type
+		ORDER BY day, error_type
+	`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error summarizing logs: %v", err)
+	}
+	defer rows.Close()
+
+	var counts []LogCount
+	for rows.Next() {
+		var count LogCount
+		if err := rows.Scan(&count.Day, &count.Type, &count.Count); err != nil {
+			return nil, fmt.Errorf("error scanning log summary: %v", err)
+		}
+		counts = append(counts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading log summary: %v", err)
+	}
+	return counts, nil
+}
+
+// pruneBatchSize limits how many rows one DELETE removes, so pruning a large
+// table doesn't hold locks that block logging for long
+const pruneBatchSize = 5000
+
+// PruneLogs deletes the rows logged before the given time and returns how
+// many were deleted
+func PruneLogs(before time.Time) (int64, error) {
+	var total int64
+	for {
+		result, err := db.Exec(`DELETE FROM errors WHERE timestamp < ? LIMIT ?`, before, pruneBatchSize)
+		if err != nil {
+			return total, fmt.Errorf("error pruning logs: %v", err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return total, fmt.Errorf("error pruning logs: %v", err)
+		}
+		total += n
+		if n < pruneBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// CountLogsBefore counts the rows PruneLogs would delete
+func CountLogsBefore(before time.Time) (int64, error) {
+	var count int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM errors WHERE timestamp < ?`, before).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error counting logs: %v", err)
+	}
+	return count, nil
+}
+
+// ParseAge parses an age such as "90d", "12h" or "1h30m". Days are 24 hours.
+func ParseAge(value string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age: %s", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid age: %s", value)
+	}
+	return age, nil
+}
@@ -0,0 +1,168 @@
+package secondaryfunctions
+
+import (
+	"fmt"
+	"time"
+)
+
+// Event types
+const (
+	EventSearch   = "search"
+	EventVerify   = "verify"
+	EventDownload = "download"
+)
+
+// maxUserAgentLength matches the size of the events.user_agent column
+const maxUserAgentLength = 255
+
+// Event is something a student's record was used for: found by a search, a
+// certificate verified or downloaded
+type Event struct {
+	ID         int64     `json:"id"`
+	StudentID  string    `json:"student_id"`
+	Type       string    `json:"type"`
+	Timestamp  time.Time `json:"timestamp"`
+	ClientIP   string    `json:"client_ip"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	DownloadID string    `json:"download_id,omitempty"`
+}
+
+// RecordEvent stores an event; a zero timestamp means now
+func RecordEvent(event Event) error {
+	if event.StudentID == "" {
+		return fmt.Errorf("student ID cannot be empty")
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	if len(event.UserAgent) > maxUserAgentLength {
+		event.UserAgent = event.UserAgent[:maxUserAgentLength]
+	}
+
+	query := `
+		INSERT INTO events (student_id, event_type, timestamp, client_ip, user_agent, download_id)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''))
+	`
+
+	_, err := db.Exec(query, event.StudentID, event.Type, event.Timestamp, event.ClientIP, event.UserAgent, event.DownloadID)
+	if err != nil {
+		return fmt.Errorf("error recording %s event for student %s: %v", event.Type, event.StudentID, err)
+	}
+	return nil
+}
+
+// ActiveStudentsSince returns the IDs of students with any event since the given time
+func ActiveStudentsSince(since time.Time) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT DISTINCT student_id FROM events WHERE timestamp >= ?`, since)
+	if err != nil {
+		return nil, fmt.Errorf("error querying events: %v", err)
+	}
+	defer rows.Close()
+
+	active := make(map[string]bool)
+	for rows.Next() {
+		var studentID string
+		if err := rows.Scan(&studentID); err != nil {
+			return nil, fmt.Errorf("error scanning event: %v", err)
+		}
+		active[studentID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading events: %v", err)
+	}
+	return active, nil
+}
+
+// ParseDateRange parses a YYYY-MM-DD date range in local time. to is inclusive, so
+// the returned end is the start of the following day. Missing dates default to
+// the last 30 days.
+func ParseDateRange(fromValue, toValue string) (from, to time.Time, err error) {
+	to = time.Now()
+	from = to.AddDate(0, 0, -30)
+
+	if fromValue != "" {
+		if from, err = time.ParseInLocation("2006-01-02", fromValue, time.Local); err != nil {
+			return from, to, fmt.Errorf("invalid from date: %s", fromValue)
+		}
+	}
+	if toValue != "" {
+		if to, err = time.ParseInLocation("2006-01-02", toValue, time.Local); err != nil {
+			return from, to, fmt.Errorf("invalid to date: %s", toValue)
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// EventStats summarises the events of one type within a period
+type EventStats struct {
+	Type     string     `json:"type"`
+	Count    int        `json:"count"`
+	Students int        `json:"students"`
+	Last     *time.Time `json:"last,omitempty"`
+}
+
+// GetEventStats counts events by type between from (inclusive) and to (exclusive)
+func GetEventStats(from, to time.Time) ([]EventStats, error) {
+	query := `
+		SELECT event_type, COUNT(*), COUNT(DISTINCT student_id), MAX(timestamp)
+		FROM events
+		WHERE timestamp >= ? AND timestamp < ?
+		GROUP BY event_type
+		ORDER BY event_type
+	`
+
+	rows, err := db.Query(query, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error querying event statistics: %v", err)
+	}
+	defer rows.Close()
+
+	stats := []EventStats{}
+	for rows.Next() {
+		var s EventStats
+		var last time.Time
+		if err := rows.Scan(&s.Type, &s.Count, &s.Students, &last); err != nil {
+			return nil, fmt.Errorf("error scanning event statistics: %v", err)
+		}
+		s.Last = &last
+		stats = append(stats, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading event statistics: %v", err)
+	}
+	return stats, nil
+}
+
+// StudentEvents returns a student's most recent events, newest first
+func StudentEvents(studentID string, limit int) ([]Event, error) {
+	query := `
+		SELECT id, student_id, event_type, timestamp, COALESCE(client_ip, ''), COALESCE(user_agent, ''), COALESCE(download_id, '')
+		FROM events
+		WHERE student_id = ?
+		ORDER BY timestamp DESC, id DESC
+		LIMIT ?
+	`
+
+	rows, err := db.Query(query, studentID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching events for student %s: %v", studentID, err)
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.ID, &e.StudentID, &e.Type, &e.Timestamp, &e.ClientIP, &e.UserAgent, &e.DownloadID); err != nil {
+			return nil, fmt.Errorf("error scanning event: %v", err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading events for student %s: %v", studentID, err)
+	}
+	return events, nil
+}
@@ -0,0 +1,261 @@
+package secondaryfunctions
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Export formats
+const (
+	ExportCSV   = "csv"
+	ExportJSONL = "jsonl"
+	ExportXLSX  = "xlsx"
+)
+
+// ExportFilter selects the students in a report. Download and verification
+// counts only include events between From (inclusive) and To (exclusive).
+type ExportFilter struct {
+	From       time.Time
+	To         time.Time
+	CourseID   string // cohort; empty for every student
+	ActiveOnly bool   // only students who downloaded or verified in the period
+}
+
+// ExportRow is one student in a report with their latest certificate and activity
+type ExportRow struct {
+	StudentID        string     `json:"student_id"`
+	FullName         string     `json:"full_name"`
+	Serial           string     `json:"serial,omitempty"`
+	Status           string     `json:"status,omitempty"` // latest certificate status, empty if never issued
+	IssuedAt         *time.Time `json:"issued_at,omitempty"`
+	Downloads        int        `json:"downloads"`
+	Verifications    int        `json:"verifications"`
+	LastDownload     *time.Time `json:"last_download,omitempty"`
+	LastVerification *time.Time `json:"last_verification,omitempty"`
+}
+
+// exportHeader names the columns of CSV and XLSX reports
+var exportHeader = []string{"student_id", "full_name", "serial", "status", "issued_at",
+	"downloads", "verifications", "last_download", "last_verification"}
+
+func (row ExportRow) record() []string {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	return []string{row.StudentID, row.FullName, row.Serial, row.Status, formatTime(row.IssuedAt),
+		strconv.Itoa(row.Downloads), strconv.Itoa(row.Verifications),
+		formatTime(row.LastDownload), formatTime(row.LastVerification)}
+}
+
+// ExportStudents calls fn for every student matching the filter, ordered by student ID
+func ExportStudents(filter ExportFilter, fn func(ExportRow) error) error {
+	query := `
+		SELECT s.student_id, s.full_name, COALESCE(c.serial, ''), COALESCE(c.status, ''), c.issued_at,
+			COALESCE(e.downloads, 0), COALESCE(e.verifications, 0), e.last_download, e.last_verification
+		FROM students s
+		LEFT JOIN (
+			SELECT serial, student_id, status, issued_at,
+				ROW_NUMBER() OVER (PARTITION BY student_id
+					ORDER BY superseded_by IS NULL DESC, issued_at DESC, serial DESC) AS position
+			FROM certificates
+		) c ON c.student_id = s.student_id AND c.position = 1
+		LEFT JOIN (
+			SELECT student_id,
+				SUM(event_type = ?) AS downloads,
+				SUM(event_type = ?) AS verifications,
+				MAX(CASE WHEN event_type = ? THEN timestamp END) AS last_download,
+				MAX(CASE WHEN event_type = ? THEN timestamp END) AS last_verification
+			FROM events
+			WHERE timestamp >= ? AND timestamp < ?
+			GROUP BY student_id
+		) e ON e.student_id = s.student_id
+		WHERE (? = '' OR s.student_id IN (SELECT student_id FROM student_courses WHERE course_id = ?))
+			AND (? = FALSE OR COALESCE(e.downloads, 0) + COALESCE(e.verifications, 0) > 0)
+		ORDER BY s.student_id
+	`
+
+	rows, err := db.Query(query, EventDownload, EventVerify, EventDownload, EventVerify,
+		filter.From, filter.To, filter.CourseID, filter.CourseID, filter.ActiveOnly)
+	if err != nil {
+		return fmt.Errorf("error querying export: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row ExportRow
+		var issuedAt, lastDownload, lastVerification sql.NullTime
+		if err := rows.Scan(&row.StudentID, &row.FullName, &row.Serial, &row.Status, &issuedAt,
+			&row.Downloads, &row.Verifications, &lastDownload, &lastVerification); err != nil {
+			return fmt.Errorf("error scanning export row: %v", err)
+		}
+		row.IssuedAt = nullTime(issuedAt)
+		row.LastDownload = nullTime(lastDownload)
+		row.LastVerification = nullTime(lastVerification)
+
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading export: %v", err)
+	}
+	return nil
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// ExportWriter writes report rows in one of the export formats. Close must be
+// called to finish the output.
+type ExportWriter interface {
+	Write(row ExportRow) error
+	Close() error
+}
+
+// NewExportWriter returns a writer for the given format
+func NewExportWriter(w io.Writer, format string) (ExportWriter, error) {
+	switch format {
+	case ExportCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(exportHeader); err != nil {
+			return nil, fmt.Errorf("error writing CSV header: %v", err)
+		}
+		return &csvExportWriter{writer: writer}, nil
+	case ExportJSONL:
+		return &jsonlExportWriter{encoder: json.NewEncoder(w)}, nil
+	case ExportXLSX:
+		return newXLSXExportWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported export format %q, expected csv, jsonl or xlsx", format)
+	}
+}
+
+type csvExportWriter struct {
+	writer *csv.Writer
+}
+
+func (c *csvExportWriter) Write(row ExportRow) error {
+	return c.writer.Write(csvSafeRecord(row.record()))
+}
+
+// csvSafe keeps a spreadsheet from reading a value, such as a name or NID from
+// an imported roster, as a formula: values starting with a formula character
+// get a leading apostrophe, which spreadsheets show as text and hide
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func csvSafeRecord(record []string) []string {
+	safe := make([]string, len(record))
+	for i, value := range record {
+		safe[i] = csvSafe(value)
+	}
+	return safe
+}
+
+func (c *csvExportWriter) Close() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+type jsonlExportWriter struct {
+	encoder *json.Encoder
+}
+
+func (j *jsonlExportWriter) Write(row ExportRow) error {
+	return j.encoder.Encode(row)
+}
+
+func (j *jsonlExportWriter) Close() error {
+	return nil
+}
+
+// xlsxExportWriter streams rows into a single sheet; the workbook is only
+// written to w on Close
+type xlsxExportWriter struct {
+	w        io.Writer
+	workbook *excelize.File
+	stream   *excelize.StreamWriter
+	row      int
+}
+
+const exportSheet = "Students"
+
+func newXLSXExportWriter(w io.Writer) (*xlsxExportWriter, error) {
+	workbook := excelize.NewFile()
+	if err := workbook.SetSheetName(workbook.GetSheetName(0), exportSheet); err != nil {
+		return nil, fmt.Errorf("error creating XLSX sheet: %v", err)
+	}
+	stream, err := workbook.NewStreamWriter(exportSheet)
+	if err != nil {
+		return nil, fmt.Errorf("error creating XLSX stream: %v", err)
+	}
+
+	x := &xlsxExportWriter{w: w, workbook: workbook, stream: stream}
+	header := make([]interface{}, len(exportHeader))
+	for i, name := range exportHeader {
+		header[i] = name
+	}
+	if err := x.writeRow(header); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *xlsxExportWriter) writeRow(values []interface{}) error {
+	x.row++
+	cell, err := excelize.CoordinatesToCellName(1, x.row)
+	if err != nil {
+		return err
+	}
+	if err := x.stream.SetRow(cell, values); err != nil {
+		return fmt.Errorf("error writing XLSX row: %v", err)
+	}
+	return nil
+}
+
+// Write stores the text columns as inline strings, which are never evaluated as
+// formulas, so unlike CSV they need no escaping
+func (x *xlsxExportWriter) Write(row ExportRow) error {
+	values := make([]interface{}, 0, len(exportHeader))
+	for i, value := range row.record() {
+		switch exportHeader[i] {
+		case "downloads":
+			values = append(values, row.Downloads)
+		case "verifications":
+			values = append(values, row.Verifications)
+		default:
+			values = append(values, value)
+		}
+	}
+	return x.writeRow(values)
+}
+
+func (x *xlsxExportWriter) Close() error {
+	defer x.workbook.Close()
+	if err := x.stream.Flush(); err != nil {
+		return fmt.Errorf("error finishing XLSX sheet: %v", err)
+	}
+	if err := x.workbook.Write(x.w); err != nil {
+		return fmt.Errorf("error writing XLSX: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package secondaryfunctions
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestCSVSafe(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", ""},
+		{"Nimal Perera", "Nimal Perera"},
+		{"=HYPERLINK(\"http://x\")", "'=HYPERLINK(\"http://x\")"},
+		{"+94771234567", "'+94771234567"},
+		{"-1+1", "'-1+1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"a=b", "a=b"},
+	}
+	for _, tt := range tests {
+		if got := csvSafe(tt.value); got != tt.want {
+			t.Errorf("csvSafe(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestExportWriterFormulas(t *testing.T) {
+	row := ExportRow{StudentID: "S1", FullName: "=1+1", Serial: "@x"}
+
+	var csvOut bytes.Buffer
+	writer, err := NewExportWriter(&csvOut, ExportCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(row); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if line := strings.Split(csvOut.String(), "\n")[1]; !strings.HasPrefix(line, "S1,'=1+1,'@x,") {
+		t.Errorf("CSV row %q doesn't escape formulas", line)
+	}
+
+	var xlsxOut bytes.Buffer
+	writer, err = NewExportWriter(&xlsxOut, ExportXLSX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Write(row); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	workbook, err := excelize.OpenReader(&xlsxOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer workbook.Close()
+	if formula, _ := workbook.GetCellFormula(exportSheet, "B2"); formula != "" {
+		t.Errorf("XLSX name cell has formula %q", formula)
+	}
+	if value, _ := workbook.GetCellValue(exportSheet, "B2"); value != "=1+1" {
+		t.Errorf("XLSX name cell = %q, want the text unchanged", value)
+	}
+}
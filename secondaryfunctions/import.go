@@ -0,0 +1,260 @@
+package secondaryfunctions
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// Import row outcomes
+const (
+	ImportCreated   = "created"
+	ImportUpdated   = "updated"
+	ImportUnchanged = "unchanged"
+	ImportFailed    = "error"
+)
+
+// importFields are the students columns a roster can fill, in report order
+var importFields = []string{"student_id", "full_name", "NID", "phone_no"}
+
+// ImportOptions controls how a roster is imported
+type ImportOptions struct {
+	// Mapping maps a students field to the roster column header holding it.
+	// Fields without a mapping are read from a column with the field's own name.
+	Mapping map[string]string
+	DryRun  bool // validate and report without writing anything
+	Upsert  bool // update students that already exist instead of failing the row
+	Admin   string
+}
+
+// ImportRowResult is the outcome of one roster row; Row is the line in the file
+type ImportRowResult struct {
+	Row       int    `json:"row"`
+	StudentID string `json:"student_id"`
+	Action    string `json:"action"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ImportReport lists the outcome of every row and counts them by action
+type ImportReport struct {
+	Rows   []ImportRowResult `json:"rows"`
+	Counts map[string]int    `json:"counts"`
+}
+
+func (r *ImportReport) add(result ImportRowResult) {
+	r.Rows = append(r.Rows, result)
+	r.Counts[result.Action]++
+}
+
+// ReadRoster reads every row of a .csv file or of one sheet of an .xlsx file.
+// An empty sheet name reads the workbook's first sheet.
+func ReadRoster(path, sheet string) ([][]string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening roster: %v", err)
+		}
+		defer file.Close()
+
+		reader := csv.NewReader(file)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV roster: %v", err)
+		}
+		return records, nil
+
+	case ".xlsx":
+		workbook, err := excelize.OpenFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening XLSX roster: %v", err)
+		}
+		defer workbook.Close()
+
+		if sheet == "" {
+			sheet = workbook.GetSheetName(0)
+		}
+		records, err := workbook.GetRows(sheet)
+		if err != nil {
+			return nil, fmt.Errorf("error reading sheet %q: %v", sheet, err)
+		}
+		return records, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported roster format %q, expected .csv or .xlsx", filepath.Ext(path))
+	}
+}
+
+// rosterColumns finds the column index of every import field in the header row
+func rosterColumns(header []string, mapping map[string]string) (map[string]int, error) {
+	positions := make(map[string]int)
+	for i, name := range header {
+		positions[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	columns := make(map[string]int)
+	for _, field := range importFields {
+		name := field
+		if mapped, ok := mapping[field]; ok {
+			name = mapped
+		}
+		if i, ok := positions[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[field] = i
+		}
+	}
+
+	for _, required := range []string{"student_id", "full_name"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("roster has no column for %s (headers: %s)", required, strings.Join(header, ", "))
+		}
+	}
+	for field := range mapping {
+		if _, ok := columns[field]; !ok {
+			return nil, fmt.Errorf("mapped column %q for %s not found", mapping[field], field)
+		}
+	}
+	return columns, nil
+}
+
+// ImportStudents validates every row of a roster, whose first row holds the
+// column headers, and creates or, with Upsert, updates the students. Empty
+// cells never overwrite existing values. Every row gets a result; a failed row
+// doesn't stop the import.
+func ImportStudents(records [][]string, opts ImportOptions) (*ImportReport, error) {
+	if len(records) == 0 {
+		return nil, fmt.Errorf("roster is empty")
+	}
+	for field := range opts.Mapping {
+		if !isImportField(field) {
+			return nil, fmt.Errorf("unknown field %q in column mapping (fields: %s)", field, strings.Join(importFields, ", "))
+		}
+	}
+
+	columns, err := rosterColumns(records[0], opts.Mapping)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{Counts: make(map[string]int)}
+	seen := make(map[string]int)
+
+	for i, record := range records[1:] {
+		row := i + 2
+		values := make(map[string]string)
+		empty := true
+		for field, column := range columns {
+			if column < len(record) {
+				values[field] = strings.TrimSpace(record[column])
+				empty = empty && values[field] == ""
+			}
+		}
+		if empty {
+			continue
+		}
+
+		person := Person{
+			StudentID: values["student_id"],
+			FullName:  values["full_name"],
+			NID:       values["NID"],
+			PhoneNo:   values["phone_no"],
+		}
+		result := ImportRowResult{Row: row, StudentID: person.StudentID}
+
+		if err := ValidatePerson(&person); err != nil {
+			result.Action, result.Error = ImportFailed, err.Error()
+			report.add(result)
+			continue
+		}
+		if first, ok := seen[person.StudentID]; ok {
+			result.Action, result.Error = ImportFailed, fmt.Sprintf("duplicate of row %d", first)
+			report.add(result)
+			continue
+		}
+		seen[person.StudentID] = row
+
+		result.Action, err = importStudent(&person, opts)
+		if err != nil {
+			result.Action, result.Error = ImportFailed, err.Error()
+		}
+		report.add(result)
+	}
+
+	return report, nil
+}
+
+func isImportField(field string) bool {
+	for _, f := range importFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// importStudent creates or updates one validated student and returns what it did
+func importStudent(person *Person, opts ImportOptions) (string, error) {
+	existing, err := GetStudent(person.StudentID)
+	if err == ErrStudentNotFound {
+		if !opts.DryRun {
+			if err := CreateStudent(person, opts.Admin, "CLI"); err != nil {
+				return "", err
+			}
+		}
+		return ImportCreated, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !opts.Upsert {
+		return "", fmt.Errorf("student already exists (use upsert to update it)")
+	}
+
+	var update StudentUpdate
+	changed := false
+	set := func(value string, current string, target **string) {
+		if value != "" && value != current {
+			v := value
+			*target = &v
+			changed = true
+		}
+	}
+	set(person.FullName, existing.FullName, &update.FullName)
+	set(person.NID, existing.NID, &update.NID)
+	set(person.PhoneNo, existing.PhoneNo, &update.PhoneNo)
+
+	if !changed {
+		return ImportUnchanged, nil
+	}
+	if !opts.DryRun {
+		if _, err := UpdateStudent(person.StudentID, update, opts.Admin, "CLI"); err != nil {
+			return "", err
+		}
+	}
+	return ImportUpdated, nil
+}
+
+// WriteImportReport writes the per-row results as CSV
+func WriteImportReport(path string, report *ImportReport) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating import report: %v", err)
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"row", "student_id", "action", "error"})
+	for _, result := range report.Rows {
+		writer.Write(csvSafeRecord([]string{fmt.Sprint(result.Row), result.StudentID, result.Action, result.Error}))
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("error writing import report: %v", err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,228 @@
+package secondaryfunctions
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Issuance statuses
+const (
+	IssuanceStatusIssued     = "issued"
+	IssuanceStatusRevoked    = "revoked"
+	IssuanceStatusSuperseded = "superseded" // replaced by a reissued certificate
+	IssuanceStatusNotIssued  = "not_issued" // reported for students without a certificate on record
+)
+
+// Errors returned by the issuance functions
+var (
+	// ErrCertificateRevoked is returned when a certificate is requested for a student
+	// whose latest certificate was revoked; only an explicit reissue replaces it
+	ErrCertificateRevoked = errors.New("certificate has been revoked")
+	// ErrCertificateNotFound is returned when revoking a certificate that isn't
+	// on record for the student
+	ErrCertificateNotFound = errors.New("certificate not found")
+	// ErrCertificateAlreadyRevoked is returned when revoking a revoked certificate
+	ErrCertificateAlreadyRevoked = errors.New("certificate is already revoked")
+)
+
+// Issuance is a record of a certificate issued to a student
+type Issuance struct {
+	Serial           string     `json:"serial"`
+	StudentID        string     `json:"student_id"`
+	TemplateKey      string     `json:"template"`
+	RenderedName     string     `json:"rendered_name"`
+	IssuedAt         time.Time  `json:"issued_at"`
+	ContentHash      string     `json:"content_hash"`
+	Status           string     `json:"status"`
+	Supersedes       string     `json:"supersedes,omitempty"`
+	SupersededBy     string     `json:"superseded_by,omitempty"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy        string     `json:"revoked_by,omitempty"`
+	RevocationReason string     `json:"revocation_reason,omitempty"`
+}
+
+// Public returns the issuance without internal details, for public verification responses
+func (i Issuance) Public() Issuance {
+	i.RevokedBy = ""
+	return i
+}
+
+const issuanceColumns = `serial, student_id, template_key, rendered_name, issued_at, COALESCE(content_hash, ''), status,
+	COALESCE(supersedes, ''), COALESCE(superseded_by, ''), revoked_at, COALESCE(revoked_by, ''), COALESCE(revocation_reason, '')`
+
+func scanIssuance(row interface{ Scan(...interface{}) error }) (*Issuance, error) {
+	var issuance Issuance
+	var revokedAt sql.NullTime
+	err := row.Scan(&issuance.Serial, &issuance.StudentID, &issuance.TemplateKey, &issuance.RenderedName,
+		&issuance.IssuedAt, &issuance.ContentHash, &issuance.Status,
+		&issuance.Supersedes, &issuance.SupersededBy, &revokedAt, &issuance.RevokedBy, &issuance.RevocationReason)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		issuance.RevokedAt = &revokedAt.Time
+	}
+	return &issuance, nil
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	execer
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// beginIssuance starts the transaction a student's certificate is issued in. It
+// locks the student's row until the transaction ends, so concurrent generations
+// for the student, on this instance or another, take turns: the later one sees
+// the certificate the earlier one issued and reprints it instead of issuing a
+// second serial.
+func beginIssuance(studentID string) (*sql.Tx, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %v", err)
+	}
+
+	var id string
+	err = tx.QueryRow(`SELECT student_id FROM students WHERE student_id = ? FOR UPDATE`, studentID).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return nil, ErrStudentNotFound
+		}
+		return nil, fmt.Errorf("error locking student %s: %v", studentID, err)
+	}
+	return tx, nil
+}
+
+// recordIssuance stores a newly issued certificate in the issuance transaction.
+// When it supersedes an earlier certificate, that one is linked to it and,
+// unless revoked, marked superseded.
+func recordIssuance(tx *sql.Tx, issuance *Issuance) error {
+	query := `
+		INSERT INTO certificates (serial, student_id, template_key, rendered_name, issued_at, content_hash, status, supersedes)
+		VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))
+	`
+
+	_, err := tx.Exec(query, issuance.Serial, issuance.StudentID, issuance.TemplateKey, issuance.RenderedName,
+		issuance.IssuedAt, issuance.ContentHash, issuance.Status, issuance.Supersedes)
+	if err != nil {
+		return fmt.Errorf("error recording certificate %s: %v", issuance.Serial, err)
+	}
+
+	if issuance.Supersedes != "" {
+		query := `
+			UPDATE certificates
+			SET superseded_by = ?, status = CASE WHEN status = ? THEN ? ELSE status END
+			WHERE serial = ?
+		`
+		_, err := tx.Exec(query, issuance.Serial, IssuanceStatusIssued, IssuanceStatusSuperseded, issuance.Supersedes)
+		if err != nil {
+			return fmt.Errorf("error superseding certificate %s: %v", issuance.Supersedes, err)
+		}
+	}
+	return nil
+}
+
+// updateIssuanceHash stores the content hash of a re-rendered certificate
+func updateIssuanceHash(ex execer, serial, contentHash string) error {
+	_, err := ex.Exec(`UPDATE certificates SET content_hash = ? WHERE serial = ?`, contentHash, serial)
+	if err != nil {
+		return fmt.Errorf("error updating certificate %s: %v", serial, err)
+	}
+	return nil
+}
+
+// revokeIssuance marks an issued or superseded certificate as revoked
+func revokeIssuance(q queryer, serial, reason, revokedBy string) error {
+	query := `
+		UPDATE certificates
+		SET status = ?, revoked_at = ?, revoked_by = ?, revocation_reason = ?
+		WHERE serial = ? AND status IN (?, ?)
+	`
+
+	result, err := q.Exec(query, IssuanceStatusRevoked, time.Now().UTC().Truncate(time.Second), revokedBy, reason,
+		serial, IssuanceStatusIssued, IssuanceStatusSuperseded)
+	if err != nil {
+		return fmt.Errorf("error revoking certificate %s: %v", serial, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		issuance, err := getIssuance(q, serial)
+		if err != nil {
+			return err
+		}
+		if issuance == nil {
+			return ErrCertificateNotFound
+		}
+		if issuance.Status == IssuanceStatusRevoked {
+			return ErrCertificateAlreadyRevoked
+		}
+		return fmt.Errorf("certificate %s is %s and cannot be revoked", serial, issuance.Status)
+	}
+	return nil
+}
+
+// GetIssuance returns the certificate with the given serial, or nil if there is none
+func GetIssuance(serial string) (*Issuance, error) {
+	return getIssuance(db, serial)
+}
+
+func getIssuance(q queryer, serial string) (*Issuance, error) {
+	row := q.QueryRow(`SELECT `+issuanceColumns+` FROM certificates WHERE serial = ?`, serial)
+	issuance, err := scanIssuance(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching certificate %s: %v", serial, err)
+	}
+	return issuance, nil
+}
+
+// LatestIssuance returns the most recently issued certificate for a student, or nil if there is none
+func LatestIssuance(studentID string) (*Issuance, error) {
+	return latestIssuance(db, studentID)
+}
+
+func latestIssuance(q queryer, studentID string) (*Issuance, error) {
+	// A superseded certificate is never the latest, even if its replacement was issued in the same second
+	query := `SELECT ` + issuanceColumns + ` FROM certificates WHERE student_id = ?
+		ORDER BY superseded_by IS NULL DESC, issued_at DESC, serial DESC LIMIT 1`
+	issuance, err := scanIssuance(q.QueryRow(query, studentID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching certificates for student %s: %v", studentID, err)
+	}
+	return issuance, nil
+}
+
+// IssuanceHistory returns every certificate issued to a student, oldest first
+func IssuanceHistory(studentID string) ([]Issuance, error) {
+	query := `SELECT ` + issuanceColumns + ` FROM certificates WHERE student_id = ? ORDER BY issued_at, serial`
+	rows, err := db.Query(query, studentID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching certificates for student %s: %v", studentID, err)
+	}
+	defer rows.Close()
+
+	history := []Issuance{}
+	for rows.Next() {
+		issuance, err := scanIssuance(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning certificate: %v", err)
+		}
+		history = append(history, *issuance)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading certificates for student %s: %v", studentID, err)
+	}
+	return history, nil
+}
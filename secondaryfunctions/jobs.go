@@ -0,0 +1,421 @@
+package secondaryfunctions
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Job statuses
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// jobPollInterval is how often idle workers look for jobs whose retry is due
+const jobPollInterval = 2 * time.Second
+
+// maxJobBackoff caps the delay between retries
+const maxJobBackoff = time.Hour
+
+// Job is a queued certificate generation for one student. A student has at
+// most one queued or running job at a time.
+type Job struct {
+	ID         int64      `json:"id"`
+	StudentID  string     `json:"student_id"`
+	Status     string     `json:"status"`
+	Attempts   int        `json:"attempts"`
+	LastError  string     `json:"last_error,omitempty"`
+	ClientIP   string     `json:"client_ip,omitempty"`
+	RequestID  string     `json:"request_id,omitempty"` // request that queued the job, carried into its logs
+	RunAfter   time.Time  `json:"run_after"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// jobWorkers wakes idle workers when a job is queued and stops them on shutdown
+var jobWorkers struct {
+	wake    chan struct{}
+	stop    chan struct{}
+	running sync.WaitGroup
+}
+
+const jobColumns = `id, student_id, status, attempts, COALESCE(last_error, ''), COALESCE(client_ip, ''),
+	COALESCE(request_id, ''), run_after, created_at, updated_at, finished_at`
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	var job Job
+	var finishedAt sql.NullTime
+	err := row.Scan(&job.ID, &job.StudentID, &job.Status, &job.Attempts, &job.LastError, &job.ClientIP,
+		&job.RequestID, &job.RunAfter, &job.CreatedAt, &job.UpdatedAt, &finishedAt)
+	if err != nil {
+		return nil, err
+	}
+	job.FinishedAt = nullTime(finishedAt)
+	return &job, nil
+}
+
+// EnqueueGeneration queues certificate generation for a student. If the
+// student already has a queued or running job, that job is returned instead and
+// created is false. The request ID carried by ctx is stored with the job.
+func EnqueueGeneration(ctx context.Context, studentID, clientIP string) (job *Job, created bool, err error) {
+	now := time.Now()
+	requestID := RequestID(ctx)
+	query := `
+		INSERT INTO generation_jobs (student_id, status, attempts, client_ip, request_id, run_after, created_at, updated_at)
+		VALUES (?, ?, 0, NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?)
+	`
+
+	result, err := db.ExecContext(ctx, query, studentID, JobQueued, clientIP, requestID, now, now, now)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == mysqlDuplicateEntry {
+		job, err := ActiveJob(studentID)
+		return job, false, err
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error queueing generation for student %s: %v", studentID, err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, false, fmt.Errorf("error reading job ID: %v", err)
+	}
+
+	select {
+	case jobWorkers.wake <- struct{}{}:
+	default:
+	}
+
+	return &Job{ID: id, StudentID: studentID, Status: JobQueued, ClientIP: clientIP, RequestID: requestID,
+		RunAfter: now, CreatedAt: now, UpdatedAt: now}, true, nil
+}
+
+// ActiveJob returns the student's queued or running job, or nil if there is none
+func ActiveJob(studentID string) (*Job, error) {
+	row := db.QueryRow(`SELECT `+jobColumns+` FROM generation_jobs WHERE active_student_id = ?`, studentID)
+	job, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching job for student %s: %v", studentID, err)
+	}
+	return job, nil
+}
+
+// GetJob returns a job by ID, or nil if there is no such job
+func GetJob(id int64) (*Job, error) {
+	job, err := scanJob(db.QueryRow(`SELECT `+jobColumns+` FROM generation_jobs WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching job %d: %v", id, err)
+	}
+	return job, nil
+}
+
+// LatestJob returns the student's most recent job, or nil if they have none
+func LatestJob(studentID string) (*Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM generation_jobs WHERE student_id = ? ORDER BY id DESC LIMIT 1`
+	job, err := scanJob(db.QueryRow(query, studentID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching latest job for student %s: %v", studentID, err)
+	}
+	return job, nil
+}
+
+// QueuePosition counts the queued jobs that will run before this one
+func QueuePosition(job *Job) (int, error) {
+	query := `
+		SELECT COUNT(*) FROM generation_jobs
+		WHERE status = ? AND (run_after < ? OR (run_after = ? AND id < ?))
+	`
+
+	var position int
+	if err := db.QueryRow(query, JobQueued, job.RunAfter, job.RunAfter, job.ID).Scan(&position); err != nil {
+		return 0, fmt.Errorf("error counting jobs ahead of job %d: %v", job.ID, err)
+	}
+	return position, nil
+}
+
+// claimJob marks the oldest due job as running and returns it, or nil if no
+// job is due. SKIP LOCKED lets several workers claim jobs at once.
+func claimJob() (*Job, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT ` + jobColumns + ` FROM generation_jobs
+		WHERE status = ? AND run_after <= ?
+		ORDER BY run_after, id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	`
+
+	job, err := scanJob(tx.QueryRow(query, JobQueued, time.Now()))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error claiming job: %v", err)
+	}
+
+	job.Status = JobRunning
+	job.Attempts++
+	job.UpdatedAt = time.Now()
+	_, err = tx.Exec(`UPDATE generation_jobs SET status = ?, attempts = ?, updated_at = ? WHERE id = ?`,
+		job.Status, job.Attempts, job.UpdatedAt, job.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error claiming job %d: %v", job.ID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing claim of job %d: %v", job.ID, err)
+	}
+	return job, nil
+}
+
+// finishJob records the outcome of a run. A failed job is queued again after
+// an exponential backoff until it runs out of attempts; a revoked certificate
+// or a missing student is not retried.
+func finishJob(job *Job, runErr error) error {
+	now := time.Now()
+	job.UpdatedAt = now
+	job.LastError = ""
+
+	switch {
+	case runErr == nil:
+		job.Status = JobDone
+		job.FinishedAt = &now
+	case runErr == ErrCertificateRevoked || runErr == ErrStudentNotFound || job.Attempts >= JobConfig.MaxAttempts:
+		job.Status = JobFailed
+		job.LastError = runErr.Error()
+		job.FinishedAt = &now
+	default:
+		backoff := JobConfig.RetryBackoff << (job.Attempts - 1)
+		if backoff <= 0 || backoff > maxJobBackoff {
+			backoff = maxJobBackoff
+		}
+		job.Status = JobQueued
+		job.LastError = runErr.Error()
+		job.RunAfter = now.Add(backoff)
+	}
+
+	query := `
+		UPDATE generation_jobs
+		SET status = ?, last_error = NULLIF(?, ''), run_after = ?, updated_at = ?, finished_at = ?
+		WHERE id = ?
+	`
+
+	_, err := db.Exec(query, job.Status, job.LastError, job.RunAfter, job.UpdatedAt, job.FinishedAt, job.ID)
+	if err != nil {
+		return fmt.Errorf("error updating job %d: %v", job.ID, err)
+	}
+
+	if job.Status == JobQueued {
+		jobResults.Inc("retry")
+	} else {
+		jobResults.Inc(job.Status)
+	}
+	return nil
+}
+
+// runJob generates the student's certificate unless the cached one is still current
+func runJob(ctx context.Context, job *Job) error {
+	person, err := GetStudent(job.StudentID)
+	if err != nil {
+		return err
+	}
+
+	path, err := CertificatePath(person.StudentID)
+	if err != nil {
+		return err
+	}
+	templateKey, err := ResolveTemplateKey(person.StudentID)
+	if err != nil {
+		return err
+	}
+	current, err := CertificateIsCurrent(person.FullName, person.StudentID, templateKey, path)
+	if err != nil {
+		slog.WarnContext(ctx, "Error checking certificate record", "student_id", person.StudentID, "error", err)
+	}
+	if current {
+		slog.DebugContext(ctx, "Certificate already current", "job_id", job.ID, "student_id", person.StudentID)
+		return nil
+	}
+
+	_, err = GenerateCertificateWithTemplate(person.FullName, person.StudentID, templateKey)
+	return err
+}
+
+// StartJobWorkers requeues jobs left running by a previous process and starts
+// the workers. onUpdate is called when a worker starts a job and after every
+// run with the generation error, including runs that will be retried.
+//
+// Requeueing assumes a single server process works the queue.
+func StartJobWorkers(workers int, onUpdate func(job Job, err error)) error {
+	result, err := db.Exec(`UPDATE generation_jobs SET status = ?, updated_at = ? WHERE status = ?`,
+		JobQueued, time.Now(), JobRunning)
+	if err != nil {
+		return fmt.Errorf("error requeueing interrupted jobs: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Requeued %d interrupted generation jobs\n", n)
+	}
+
+	jobWorkers.wake = make(chan struct{}, workers)
+	jobWorkers.stop = make(chan struct{})
+	for i := 0; i < workers; i++ {
+		jobWorkers.running.Add(1)
+		go func() {
+			defer jobWorkers.running.Done()
+			jobWorker(onUpdate)
+		}()
+	}
+	log.Printf("Started %d certificate generation workers\n", workers)
+	return nil
+}
+
+// StopJobWorkers stops the workers from taking new jobs and waits until the
+// jobs they are running finish or ctx is done. Jobs still running then are
+// requeued when the server next starts.
+func StopJobWorkers(ctx context.Context) error {
+	if jobWorkers.stop == nil {
+		return nil
+	}
+	close(jobWorkers.stop)
+
+	finished := make(chan struct{})
+	go func() {
+		jobWorkers.running.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("generation jobs still running: %v", ctx.Err())
+	}
+}
+
+func jobWorker(onUpdate func(job Job, err error)) {
+	for {
+		select {
+		case <-jobWorkers.stop:
+			return
+		default:
+		}
+
+		job, err := claimJob()
+		if err != nil {
+			log.Printf("Error claiming generation job: %v\n", err)
+		}
+		if job == nil {
+			select {
+			case <-jobWorkers.wake:
+			case <-time.After(jobPollInterval):
+			case <-jobWorkers.stop:
+				return
+			}
+			continue
+		}
+		onUpdate(*job, nil)
+
+		ctx := WithRequestID(context.Background(), job.RequestID)
+		started := time.Now()
+		runErr := runJob(ctx, job)
+		if err := finishJob(job, runErr); err != nil {
+			slog.ErrorContext(ctx, "Error recording generation job result", "job_id", job.ID, "error", err)
+		}
+		switch {
+		case runErr == nil:
+			slog.InfoContext(ctx, "Generation job done", "job_id", job.ID, "student_id", job.StudentID,
+				"duration", time.Since(started))
+		case job.Status == JobQueued:
+			slog.WarnContext(ctx, "Generation job failed, retrying", "job_id", job.ID, "student_id", job.StudentID,
+				"attempt", job.Attempts, "retry_at", job.RunAfter, "error", runErr)
+		}
+		onUpdate(*job, runErr)
+	}
+}
+
+// QueueStats counts jobs by status
+func QueueStats() (map[string]int, error) {
+	rows, err := db.Query(`SELECT status, COUNT(*) FROM generation_jobs GROUP BY status`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying job statistics: %v", err)
+	}
+	defer rows.Close()
+
+	counts := map[string]int{JobQueued: 0, JobRunning: 0, JobDone: 0, JobFailed: 0}
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, fmt.Errorf("error scanning job statistics: %v", err)
+		}
+		counts[status] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading job statistics: %v", err)
+	}
+	return counts, nil
+}
+
+// QueueDepth counts the jobs waiting for a worker
+func QueueDepth() (int, error) {
+	var depth int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM generation_jobs WHERE status = ?`, JobQueued).Scan(&depth); err != nil {
+		return 0, fmt.Errorf("error counting queued jobs: %v", err)
+	}
+	return depth, nil
+}
+
+// FailedJobs returns the most recently failed jobs, newest first
+func FailedJobs(limit int) ([]Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM generation_jobs WHERE status = ? ORDER BY updated_at DESC, id DESC LIMIT ?`
+	rows, err := db.Query(query, JobFailed, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching failed jobs: %v", err)
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning job: %v", err)
+		}
+		jobs = append(jobs, *job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading failed jobs: %v", err)
+	}
+	return jobs, nil
+}
+
+// PurgeJobs deletes finished jobs that ended before the given time
+func PurgeJobs(before time.Time) (int64, error) {
+	result, err := db.Exec(`DELETE FROM generation_jobs WHERE status IN (?, ?) AND finished_at < ?`,
+		JobDone, JobFailed, before)
+	if err != nil {
+		return 0, fmt.Errorf("error purging jobs: %v", err)
+	}
+	return result.RowsAffected()
+}
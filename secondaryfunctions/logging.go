@@ -0,0 +1,412 @@
+package secondaryfunctions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LevelOff turns the errors table sink off when used as LOG_DB_LEVEL
+const LevelOff = slog.Level(100)
+
+// LogConfig controls where log records go. Every record at Level or above is
+// written to standard error; records at DBLevel or above are also written to
+// the errors table, which the cleanup prunes down to Retention.
+var LogConfig struct {
+	Level     slog.Level
+	Format    string // "json" or "text"
+	DBLevel   slog.Level
+	Retention time.Duration // 0 keeps rows forever
+}
+
+// eventLevels is the level each LogError event type is logged at. Types not
+// listed are errors.
+var eventLevels = map[string]slog.Level{
+	"server_startup":             slog.LevelInfo,
+	"server_listening":           slog.LevelInfo,
+	"server_shutdown":            slog.LevelInfo,
+	"cleanup_success":            slog.LevelInfo,
+	"record_not_found":           slog.LevelInfo,
+	"validation_failure":         slog.LevelWarn,
+	"invalid_request":            slog.LevelWarn,
+	"invalid_stats_request":      slog.LevelWarn,
+	"admin_unauthorized":         slog.LevelWarn,
+	"connection_limit":           slog.LevelWarn,
+	"incomplete_download":        slog.LevelWarn,
+	"verification_failure":       slog.LevelWarn,
+	"token_verification_failure": slog.LevelWarn,
+	"rate_limited":               slog.LevelWarn,
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context whose log records carry the request ID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	if requestID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns the request ID carried by ctx, or "" if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// LogError logs an event of the given type at its level in eventLevels
+func LogError(errorType string, remark string) {
+	LogErrorContext(context.Background(), errorType, remark)
+}
+
+// LogErrorContext is LogError for an event that belongs to a request or job
+func LogErrorContext(ctx context.Context, errorType string, remark string) {
+	level, ok := eventLevels[errorType]
+	if !ok {
+		level = slog.LevelError
+	}
+	LogEvent(ctx, level, errorType, remark)
+}
+
+// LogEvent logs an event of the given type at level. The type becomes the
+// error_type of the errors table row.
+func LogEvent(ctx context.Context, level slog.Level, eventType, remark string) {
+	slog.Log(ctx, level, remark, "event", eventType)
+}
+
+// logOutput is where the console handler writes; see SetLogOutput
+var logOutput struct {
+	sync.Mutex
+	w io.Writer
+}
+
+type consoleWriter struct{}
+
+func (consoleWriter) Write(p []byte) (int, error) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	return logOutput.w.Write(p)
+}
+
+// SetLogOutput sends console log records to w instead of standard error until
+// the returned function is called
+func SetLogOutput(w io.Writer) (restore func()) {
+	logOutput.Lock()
+	previous := logOutput.w
+	logOutput.w = w
+	logOutput.Unlock()
+	return func() {
+		logOutput.Lock()
+		logOutput.w = previous
+		logOutput.Unlock()
+	}
+}
+
+// consoleLogger writes only to the console. The errors table sink reports its
+// own failures through it so they can't loop back into the sink.
+var consoleLogger = slog.Default()
+
+// initLogging installs the default slog logger from LOG_LEVEL, LOG_FORMAT and
+// LOG_DB_LEVEL, and reads LOG_RETENTION. Output from the log package goes
+// through it at info level.
+func initLogging() {
+	logOutput.w = os.Stderr
+
+	var invalid []string
+	LogConfig.Level = envLevel("LOG_LEVEL", slog.LevelInfo, &invalid)
+	LogConfig.DBLevel = envLevel("LOG_DB_LEVEL", slog.LevelWarn, &invalid)
+	LogConfig.Retention = 90 * 24 * time.Hour
+	if value := os.Getenv("LOG_RETENTION"); strings.EqualFold(value, "off") {
+		LogConfig.Retention = 0
+	} else if value != "" {
+		if retention, err := ParseAge(value); err == nil {
+			LogConfig.Retention = retention
+		} else {
+			invalid = append(invalid, "LOG_RETENTION")
+		}
+	}
+	LogConfig.Format = os.Getenv("LOG_FORMAT")
+	if LogConfig.Format != "json" && LogConfig.Format != "text" {
+		if LogConfig.Format != "" {
+			invalid = append(invalid, "LOG_FORMAT")
+		}
+		// Readable on a terminal, machine readable under systemd
+		LogConfig.Format = "json"
+		if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			LogConfig.Format = "text"
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: LogConfig.Level}
+	var console slog.Handler = slog.NewJSONHandler(consoleWriter{}, options)
+	if LogConfig.Format == "text" {
+		console = slog.NewTextHandler(consoleWriter{}, options)
+	}
+	consoleLogger = slog.New(contextHandler{console})
+
+	handlers := fanoutHandler{console}
+	if LogConfig.DBLevel < LevelOff {
+		dbLog.rows = make(chan logRow, dbLogQueueSize)
+		dbLog.done = make(chan struct{})
+		go runDBLogWriter()
+		handlers = append(handlers, &dbLogHandler{level: LogConfig.DBLevel})
+	}
+	slog.SetDefault(slog.New(contextHandler{handlers}))
+
+	for _, name := range invalid {
+		slog.Warn("Ignoring invalid log setting", "name", name, "value", os.Getenv(name))
+	}
+}
+
+// envLevel reads a level name such as "info" or "warn", or "off" for LevelOff
+func envLevel(name string, defaultLevel slog.Level, invalid *[]string) slog.Level {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultLevel
+	}
+	if strings.EqualFold(value, "off") {
+		return LevelOff
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		*invalid = append(*invalid, name)
+		return defaultLevel
+	}
+	return level
+}
+
+// contextHandler adds the request ID carried by the context to each record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r = r.Clone()
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// fanoutHandler passes each record to every handler enabled for its level
+type fanoutHandler []slog.Handler
+
+func (f fanoutHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range f {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(fanoutHandler, len(f))
+	for i, h := range f {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (f fanoutHandler) WithGroup(name string) slog.Handler {
+	handlers := make(fanoutHandler, len(f))
+	for i, h := range f {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+const (
+	dbLogQueueSize     = 1024            // records waiting to be written before new ones are dropped
+	dbLogBatchSize     = 100             // rows per INSERT
+	dbLogFlushInterval = 2 * time.Second // how long a record waits for a batch to fill
+	maxErrorTypeLength = 50              // size of errors.error_type
+)
+
+// logRow is one row of the errors table
+type logRow struct {
+	timestamp time.Time
+	errorType string
+	remark    string
+}
+
+// dbLog queues records for the errors table. A single writer inserts them in
+// batches so logging never waits on the database; when it falls behind,
+// records are dropped and counted.
+var dbLog struct {
+	sync.RWMutex
+	rows    chan logRow
+	closed  bool
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+// dbLogHandler writes records to the errors table. The event attribute set by
+// LogEvent becomes the error type; other attributes are appended to the remark
+// the same way the remarks separate their fields.
+type dbLogHandler struct {
+	level slog.Level
+	attrs []string // formatted attributes from WithAttrs
+	group string   // prefix for attribute keys from WithGroup
+}
+
+func (h *dbLogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *dbLogHandler) Handle(_ context.Context, r slog.Record) error {
+	row := logRow{timestamp: r.Time, errorType: "log_" + strings.ToLower(r.Level.String())}
+	parts := append([]string{r.Message}, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "event" && h.group == "" {
+			row.errorType = a.Value.String()
+			return true
+		}
+		parts = appendLogAttr(parts, h.group, a)
+		return true
+	})
+	if len(row.errorType) > maxErrorTypeLength {
+		row.errorType = row.errorType[:maxErrorTypeLength]
+	}
+	row.remark = strings.Join(parts, " | ")
+
+	dbLog.RLock()
+	defer dbLog.RUnlock()
+	if dbLog.closed {
+		return nil
+	}
+	select {
+	case dbLog.rows <- row:
+	default:
+		dbLog.dropped.Add(1)
+		droppedLogs.Inc()
+	}
+	return nil
+}
+
+func (h *dbLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append([]string(nil), h.attrs...)
+	for _, a := range attrs {
+		clone.attrs = appendLogAttr(clone.attrs, h.group, a)
+	}
+	return &clone
+}
+
+func (h *dbLogHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.group = h.group + name + "."
+	return &clone
+}
+
+// appendLogAttr formats an attribute as "key: value", flattening groups
+func appendLogAttr(parts []string, prefix string, a slog.Attr) []string {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, member := range a.Value.Group() {
+			parts = appendLogAttr(parts, prefix, member)
+		}
+		return parts
+	}
+	if a.Key == "" {
+		return parts
+	}
+	return append(parts, fmt.Sprintf("%s%s: %v", prefix, a.Key, a.Value.Any()))
+}
+
+func runDBLogWriter() {
+	defer close(dbLog.done)
+	ticker := time.NewTicker(dbLogFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]logRow, 0, dbLogBatchSize)
+	for {
+		select {
+		case row, ok := <-dbLog.rows:
+			if !ok {
+				writeLogRows(batch)
+				return
+			}
+			batch = append(batch, row)
+			if len(batch) < dbLogBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		writeLogRows(batch)
+		batch = batch[:0]
+	}
+}
+
+// writeLogRows inserts a batch into the errors table. A failed batch is only
+// reported on the console, where its records were already written.
+func writeLogRows(rows []logRow) {
+	if dropped := dbLog.dropped.Swap(0); dropped > 0 {
+		consoleLogger.Warn("Dropped log records for the errors table because the queue was full", "count", dropped)
+	}
+	if len(rows) == 0 || db == nil {
+		return
+	}
+
+	placeholders := make([]string, len(rows))
+	args := make([]interface{}, 0, 3*len(rows))
+	for i, row := range rows {
+		placeholders[i] = "(?, ?, ?)"
+		args = append(args, row.timestamp, row.errorType, row.remark)
+	}
+	query := `INSERT INTO errors (timestamp, error_type, remark) VALUES ` + strings.Join(placeholders, ", ")
+
+	if _, err := db.Exec(query, args...); err != nil {
+		consoleLogger.Error("Error logging to errors table", "rows", len(rows), "error", err)
+	}
+}
+
+// CloseLogs writes the records still queued for the errors table, waiting
+// until ctx is done. Records logged afterwards only go to the console.
+func CloseLogs(ctx context.Context) error {
+	dbLog.Lock()
+	if dbLog.rows == nil || dbLog.closed {
+		dbLog.Unlock()
+		return nil
+	}
+	dbLog.closed = true
+	close(dbLog.rows)
+	dbLog.Unlock()
+
+	select {
+	case <-dbLog.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("log records not written to the errors table: %v", ctx.Err())
+	}
+}
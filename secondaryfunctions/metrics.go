@@ -0,0 +1,338 @@
+package secondaryfunctions
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small in-process metrics registry written out in the Prometheus text
+// exposition format. Series are keyed by their label values in the order the
+// metric declares its label names.
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var metricsRegistry struct {
+	sync.Mutex
+	metrics []metric
+}
+
+func registerMetric(m metric) {
+	metricsRegistry.Lock()
+	metricsRegistry.metrics = append(metricsRegistry.metrics, m)
+	metricsRegistry.Unlock()
+}
+
+// WriteMetrics writes every registered metric in the Prometheus text format
+func WriteMetrics(w io.Writer) {
+	metricsRegistry.Lock()
+	metrics := append([]metric(nil), metricsRegistry.metrics...)
+	metricsRegistry.Unlock()
+
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
+
+// DefaultBuckets are latency buckets in seconds, from 5ms to 1 minute
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// series holds the samples of a metric for one combination of label values
+type series struct {
+	labels []string
+	value  float64
+	counts []uint64 // histograms only: observations per bucket, not cumulative
+	sum    float64
+}
+
+type metricVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	kind   string
+	labels []string
+	series map[string]*series
+}
+
+func newMetricVec(name, help, kind string, labels []string) metricVec {
+	return metricVec{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+}
+
+// get returns the series for values; the caller must hold the lock
+func (v *metricVec) get(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", v.name, len(values), len(v.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), values...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+// sorted returns the series ordered by label values so output is stable; the
+// caller must hold the lock
+func (v *metricVec) sorted() []*series {
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sorted := make([]*series, len(keys))
+	for i, key := range keys {
+		sorted[i] = v.series[key]
+	}
+	return sorted
+}
+
+func (v *metricVec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+}
+
+// CounterVec is a set of counters partitioned by labels
+type CounterVec struct {
+	metricVec
+}
+
+// NewCounterVec creates and registers a counter
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newMetricVec(name, help, "counter", labels)}
+	registerMetric(c)
+	return c
+}
+
+// Inc adds one to the counter with the given label values
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds delta, which must not be negative, to the counter with the given label values
+func (c *CounterVec) Add(delta float64, values ...string) {
+	c.Lock()
+	c.get(values).value += delta
+	c.Unlock()
+}
+
+func (c *CounterVec) writeTo(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	c.writeHeader(w)
+	for _, s := range c.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labels), formatValue(s.value))
+	}
+}
+
+// GaugeVec is a set of gauges partitioned by labels
+type GaugeVec struct {
+	metricVec
+}
+
+// NewGaugeVec creates and registers a gauge
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newMetricVec(name, help, "gauge", labels)}
+	registerMetric(g)
+	return g
+}
+
+// Set sets the gauge with the given label values
+func (g *GaugeVec) Set(value float64, values ...string) {
+	g.Lock()
+	g.get(values).value = value
+	g.Unlock()
+}
+
+// Add adds delta, which may be negative, to the gauge with the given label values
+func (g *GaugeVec) Add(delta float64, values ...string) {
+	g.Lock()
+	g.get(values).value += delta
+	g.Unlock()
+}
+
+func (g *GaugeVec) writeTo(w io.Writer) {
+	g.Lock()
+	defer g.Unlock()
+	g.writeHeader(w)
+	for _, s := range g.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, s.labels), formatValue(s.value))
+	}
+}
+
+// GaugeFunc is a gauge read when metrics are written, for values that are
+// cheaper to look up than to track
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() (float64, error)
+}
+
+// NewGaugeFunc creates and registers a gauge whose value comes from fn. If fn
+// fails the sample is left out and the error logged.
+func NewGaugeFunc(name, help string, fn func() (float64, error)) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, value: fn}
+	registerMetric(g)
+	return g
+}
+
+func (g *GaugeFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	value, err := g.value()
+	if err != nil {
+		log.Printf("Error reading metric %s: %v", g.name, err)
+		return
+	}
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(value))
+}
+
+// HistogramVec is a set of histograms partitioned by labels
+type HistogramVec struct {
+	metricVec
+	buckets []float64
+}
+
+// NewHistogramVec creates and registers a histogram with the given upper
+// bucket bounds, which must be sorted
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{newMetricVec(name, help, "histogram", labels), buckets}
+	registerMetric(h)
+	return h
+}
+
+// Observe records one value in the histogram with the given label values
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	h.Lock()
+	defer h.Unlock()
+	s := h.get(values)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets)+1)
+	}
+	s.counts[sort.SearchFloat64s(h.buckets, value)]++
+	s.sum += value
+}
+
+// ObserveSince records the seconds elapsed since start
+func (h *HistogramVec) ObserveSince(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *HistogramVec) writeTo(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	h.writeHeader(w)
+	names := append(append([]string(nil), h.labels...), "le")
+	for _, s := range h.sorted() {
+		values := append(append([]string(nil), s.labels...), "")
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			values[len(values)-1] = "+Inf"
+			if i < len(h.buckets) {
+				values[len(values)-1] = formatValue(h.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, values), cumulative)
+		}
+		labels := formatLabels(h.labels, s.labels)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, cumulative)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Metrics recorded by this package
+
+var (
+	generationCount = NewCounterVec("goqr_certificate_generations_total",
+		"Certificates generated, by result (success, failure or revoked).", "result")
+	generationDuration = NewHistogramVec("goqr_certificate_generation_duration_seconds",
+		"Time taken to generate a certificate successfully.", DefaultBuckets)
+	jobResults = NewCounterVec("goqr_generation_jobs_total",
+		"Generation job attempts, by outcome (done, retry or failed).", "status")
+	_ = NewGaugeFunc("goqr_generation_queue_depth",
+		"Generation jobs waiting for a worker.", func() (float64, error) {
+			depth, err := QueueDepth()
+			return float64(depth), err
+		})
+
+	droppedLogs = NewCounterVec("goqr_log_records_dropped_total",
+		"Log records not written to the errors table because its queue was full.")
+
+	cleanupRuns = NewCounterVec("goqr_cleanup_runs_total",
+		"Cleanup runs, by result (success or error).", "result")
+	cleanupLastRun = NewGaugeVec("goqr_cleanup_last_run_timestamp_seconds",
+		"Unix time the last cleanup run started.")
+	cleanupLastDuration = NewGaugeVec("goqr_cleanup_last_run_duration_seconds",
+		"Duration of the last cleanup run.")
+	cleanupFilesScanned = NewCounterVec("goqr_cleanup_files_scanned_total",
+		"Files examined by cleanup runs.")
+	cleanupFilesDeleted = NewCounterVec("goqr_cleanup_files_deleted_total",
+		"Files deleted by cleanup runs.")
+	cleanupBytesFreed = NewCounterVec("goqr_cleanup_bytes_freed_total",
+		"Bytes freed by cleanup runs.")
+	cleanupErrors = NewCounterVec("goqr_cleanup_errors_total",
+		"Errors encountered by cleanup runs.")
+)
+
+func init() {
+	// Start the outcomes at zero so rates and alerts work before the first one happens
+	for _, result := range []string{"success", "failure", "revoked"} {
+		generationCount.Add(0, result)
+	}
+	for _, status := range []string{"done", "retry", "failed"} {
+		jobResults.Add(0, status)
+	}
+}
+
+// recordGeneration counts a certificate generation and times successful ones
+func recordGeneration(start time.Time, err error) {
+	switch {
+	case err == nil:
+		generationCount.Inc("success")
+		generationDuration.ObserveSince(start)
+	case err == ErrCertificateRevoked:
+		generationCount.Inc("revoked")
+	default:
+		generationCount.Inc("failure")
+	}
+}
+
+// recordCleanup exports the stats of a finished or failed cleanup run
+func recordCleanup(stats *CleanupStats, result string) {
+	cleanupRuns.Inc(result)
+	cleanupLastRun.Set(float64(stats.StartTime.Unix()))
+	cleanupLastDuration.Set(time.Since(stats.StartTime).Seconds())
+	cleanupFilesScanned.Add(float64(stats.FilesScanned))
+	cleanupFilesDeleted.Add(float64(stats.FilesDeleted))
+	cleanupBytesFreed.Add(float64(stats.BytesFreed))
+	cleanupErrors.Add(float64(stats.ErrorCount))
+}
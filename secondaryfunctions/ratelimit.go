@@ -0,0 +1,177 @@
+package secondaryfunctions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Rate limit backends
+const (
+	RateLimitMemory = "memory" // buckets in this process
+	RateLimitMySQL  = "mysql"  // buckets in the rate_limit_buckets table, shared by every instance
+)
+
+// rateLimitSweepInterval is how often the memory backend drops buckets that
+// have filled up again
+const rateLimitSweepInterval = time.Minute
+
+// RateLimiter enforces token bucket limits. Each key has its own bucket of
+// burst tokens that refills at a steady rate; a request takes one token.
+type RateLimiter struct {
+	store rateLimitStore
+}
+
+type rateLimitStore interface {
+	take(key string, perSecond float64, burst int) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// NewRateLimiter returns a limiter keeping its buckets in the given backend
+func NewRateLimiter(backend string) (*RateLimiter, error) {
+	switch backend {
+	case "", RateLimitMemory:
+		return &RateLimiter{store: newMemoryRateLimitStore(time.Now)}, nil
+	case RateLimitMySQL:
+		return &RateLimiter{store: mysqlRateLimitStore{}}, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit backend: %s", backend)
+	}
+}
+
+// Allow takes a token from the key's bucket, which holds burst tokens and
+// gains perMinute tokens a minute. When the bucket is empty it returns false
+// and how long until a token is available.
+func (l *RateLimiter) Allow(key string, perMinute float64, burst int) (bool, time.Duration, error) {
+	return l.store.take(key, perMinute/60, burst)
+}
+
+// takeToken refills a bucket that last changed elapsed ago and takes a token
+// if one is available. It returns the tokens left, whether one was taken, how
+// long until the next one and how long until the bucket is full again.
+func takeToken(tokens float64, elapsed time.Duration, perSecond float64, burst int) (float64, bool, time.Duration, time.Duration) {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	tokens = math.Min(float64(burst), tokens+elapsed.Seconds()*perSecond)
+
+	allowed := tokens >= 1
+	var retryAfter time.Duration
+	if allowed {
+		tokens--
+	} else {
+		retryAfter = secondsDuration((1 - tokens) / perSecond)
+	}
+	return tokens, allowed, retryAfter, secondsDuration((float64(burst) - tokens) / perSecond)
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(math.Ceil(seconds * float64(time.Second)))
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // when the bucket will be full again and can be forgotten
+}
+
+// memoryRateLimitStore keeps buckets in a map, dropping full ones now and then
+type memoryRateLimitStore struct {
+	sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newMemoryRateLimitStore(now func() time.Time) *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*memoryBucket), now: now}
+}
+
+func (s *memoryRateLimitStore) take(key string, perSecond float64, burst int) (bool, time.Duration, error) {
+	now := s.now()
+	s.Lock()
+	defer s.Unlock()
+
+	if now.Sub(s.lastSweep) >= rateLimitSweepInterval {
+		for k, bucket := range s.buckets {
+			if now.After(bucket.full) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(burst), updated: now}
+		s.buckets[key] = bucket
+	}
+
+	tokens, allowed, retryAfter, untilFull := takeToken(bucket.tokens, now.Sub(bucket.updated), perSecond, burst)
+	bucket.tokens, bucket.updated, bucket.full = tokens, now, now.Add(untilFull)
+	return allowed, retryAfter, nil
+}
+
+// mysqlRateLimitStore keeps buckets in the rate_limit_buckets table. The row
+// lock serializes instances taking from the same bucket, and the database
+// clock is used so instances don't need synchronized clocks. Keys are hashed
+// so no client IPs or search terms are stored.
+type mysqlRateLimitStore struct{}
+
+func (mysqlRateLimitStore) take(key string, perSecond float64, burst int) (bool, time.Duration, error) {
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, 0, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// New buckets start full
+	_, err = tx.Exec(`
+		INSERT INTO rate_limit_buckets (bucket_key, tokens, updated_at, full_at)
+		VALUES (?, ?, NOW(6), NOW(6))
+		ON DUPLICATE KEY UPDATE bucket_key = bucket_key
+	`, hash, float64(burst))
+	if err != nil {
+		return false, 0, fmt.Errorf("error creating rate limit bucket: %v", err)
+	}
+
+	var tokens float64
+	var elapsed int64
+	err = tx.QueryRow(`
+		SELECT tokens, TIMESTAMPDIFF(MICROSECOND, updated_at, NOW(6))
+		FROM rate_limit_buckets WHERE bucket_key = ? FOR UPDATE
+	`, hash).Scan(&tokens, &elapsed)
+	if err != nil {
+		return false, 0, fmt.Errorf("error reading rate limit bucket: %v", err)
+	}
+
+	tokens, allowed, retryAfter, untilFull := takeToken(tokens, time.Duration(elapsed)*time.Microsecond, perSecond, burst)
+	_, err = tx.Exec(`
+		UPDATE rate_limit_buckets
+		SET tokens = ?, updated_at = NOW(6), full_at = NOW(6) + INTERVAL ? MICROSECOND
+		WHERE bucket_key = ?
+	`, tokens, untilFull.Microseconds(), hash)
+	if err != nil {
+		return false, 0, fmt.Errorf("error updating rate limit bucket: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, 0, fmt.Errorf("error committing rate limit bucket: %v", err)
+	}
+	return allowed, retryAfter, nil
+}
+
+// PruneRateLimits deletes the shared buckets that have filled up again, which
+// behave the same as missing ones
+func PruneRateLimits() (int64, error) {
+	result, err := db.Exec(`DELETE FROM rate_limit_buckets WHERE full_at < NOW(6)`)
+	if err != nil {
+		return 0, fmt.Errorf("error pruning rate limit buckets: %v", err)
+	}
+	return result.RowsAffected()
+}
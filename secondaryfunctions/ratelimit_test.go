@@ -0,0 +1,112 @@
+package secondaryfunctions
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTakeToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		tokens        float64
+		elapsed       time.Duration
+		perSecond     float64
+		burst         int
+		wantTokens    float64
+		wantAllowed   bool
+		wantRetry     time.Duration
+		wantUntilFull time.Duration
+	}{
+		{"full bucket", 5, 0, 1, 5, 4, true, 0, time.Second},
+		{"empty bucket", 0.5, 0, 1, 5, 0.5, false, 500 * time.Millisecond, 4500 * time.Millisecond},
+		{"refill", 0, 2 * time.Second, 1, 5, 1, true, 0, 4 * time.Second},
+		{"partial refill", 0, 500 * time.Millisecond, 1, 5, 0.5, false, 500 * time.Millisecond, 4500 * time.Millisecond},
+		{"capped at burst", 3, time.Hour, 1, 5, 4, true, 0, time.Second},
+		{"clock went back", 0, -5 * time.Second, 1, 5, 0, false, time.Second, 5 * time.Second},
+		{"slow rate", 0, 0, 0.5, 2, 0, false, 2 * time.Second, 4 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, allowed, retry, untilFull := takeToken(tt.tokens, tt.elapsed, tt.perSecond, tt.burst)
+			if math.Abs(tokens-tt.wantTokens) > 1e-9 {
+				t.Errorf("tokens = %g, want %g", tokens, tt.wantTokens)
+			}
+			if allowed != tt.wantAllowed {
+				t.Errorf("allowed = %v, want %v", allowed, tt.wantAllowed)
+			}
+			if retry != tt.wantRetry {
+				t.Errorf("retryAfter = %v, want %v", retry, tt.wantRetry)
+			}
+			if untilFull != tt.wantUntilFull {
+				t.Errorf("untilFull = %v, want %v", untilFull, tt.wantUntilFull)
+			}
+		})
+	}
+}
+
+// fakeClock is a clock for the memory store that only moves when told to
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time          { return c.now }
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 8, 31, 12, 0, 0, 0, time.UTC)}
+	store := newMemoryRateLimitStore(clock.Now)
+	limiter := &RateLimiter{store: store}
+
+	allow := func(key string) (bool, time.Duration) {
+		t.Helper()
+		allowed, retry, err := limiter.Allow(key, 60, 3)
+		if err != nil {
+			t.Fatalf("Allow(%q): %v", key, err)
+		}
+		return allowed, retry
+	}
+
+	// A new bucket starts full
+	for i := 0; i < 3; i++ {
+		if allowed, _ := allow("a"); !allowed {
+			t.Fatalf("request %d within the burst was rejected", i+1)
+		}
+	}
+	if allowed, retry := allow("a"); allowed || retry != time.Second {
+		t.Errorf("request over the burst: allowed %v, retry %v; want rejected, retry 1s", allowed, retry)
+	}
+
+	// Other keys have their own bucket
+	if allowed, _ := allow("b"); !allowed {
+		t.Error("request for another key was rejected")
+	}
+
+	// One token a second
+	clock.Advance(time.Second)
+	if allowed, _ := allow("a"); !allowed {
+		t.Error("request after a refill was rejected")
+	}
+	if allowed, _ := allow("a"); allowed {
+		t.Error("second request after refilling one token was allowed")
+	}
+
+	// A long wait refills only up to the burst
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if allowed, _ := allow("a"); !allowed {
+			t.Fatalf("request %d after a long wait was rejected", i+1)
+		}
+	}
+	if allowed, _ := allow("a"); allowed {
+		t.Error("request over the burst after a long wait was allowed")
+	}
+
+	// Full buckets are forgotten by the next sweep
+	clock.Advance(rateLimitSweepInterval)
+	allow("c")
+	if _, ok := store.buckets["a"]; ok {
+		t.Error("full bucket kept after a sweep")
+	}
+	if _, ok := store.buckets["c"]; !ok {
+		t.Error("bucket in use dropped by a sweep")
+	}
+}
@@ -0,0 +1,34 @@
+package secondaryfunctions
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/Sathimantha/goqr/certificate"
+)
+
+var signingKeyring struct {
+	once    sync.Once
+	keyring *certificate.Keyring
+	err     error
+}
+
+// Keyring returns the certificate signing keys, loading them on first use.
+// It returns nil without an error when no active key ID is configured.
+func Keyring() (*certificate.Keyring, error) {
+	signingKeyring.once.Do(func() {
+		if SigningConfig.ActiveKeyID == "" {
+			log.Println("SIGNING_KEY_ID is not set; certificate QR codes will not be signed")
+			return
+		}
+
+		keyring, err := certificate.LoadKeyring(SigningConfig.KeysDir, SigningConfig.ActiveKeyID)
+		if err != nil {
+			signingKeyring.err = fmt.Errorf("Error loading signing keys: %v", err)
+			return
+		}
+		signingKeyring.keyring = keyring
+	})
+	return signingKeyring.keyring, signingKeyring.err
+}
@@ -0,0 +1,353 @@
+package secondaryfunctions
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Errors returned by the student management functions
+var (
+	ErrStudentNotFound = errors.New("student not found")
+	ErrStudentExists   = errors.New("student already exists")
+)
+
+// mysqlDuplicateEntry is the MySQL error number for a primary key conflict
+const mysqlDuplicateEntry = 1062
+
+// maxNameLength is the size of the students.full_name column
+const maxNameLength = 100
+
+// ValidationError reports student data that doesn't pass validation
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func validationErrorf(format string, args ...interface{}) error {
+	return &ValidationError{Message: fmt.Sprintf(format, args...)}
+}
+
+// ValidatePerson checks a student record against ValidationPatterns. NID and
+// phone number are optional.
+func ValidatePerson(person *Person) error {
+	if !ValidationPatterns.StudentID.MatchString(person.StudentID) {
+		return validationErrorf("invalid student ID: %q", person.StudentID)
+	}
+	if !ValidationPatterns.Name.MatchString(person.FullName) || strings.TrimSpace(person.FullName) == "" {
+		return validationErrorf("invalid full name: %q", person.FullName)
+	}
+	if utf8.RuneCountInString(person.FullName) > maxNameLength {
+		return validationErrorf("full name is longer than %d characters", maxNameLength)
+	}
+	if person.NID != "" && !ValidationPatterns.NID.MatchString(person.NID) {
+		return validationErrorf("invalid NID: %q", person.NID)
+	}
+	if person.PhoneNo != "" && !ValidationPatterns.PhoneNo.MatchString(person.PhoneNo) {
+		return validationErrorf("invalid phone number: %q", person.PhoneNo)
+	}
+	return nil
+}
+
+// validateTemplateKey checks that a student's template key, if set, is registered
+func validateTemplateKey(templateKey string) error {
+	if templateKey == "" {
+		return nil
+	}
+	templates, err := Templates()
+	if err != nil {
+		return fmt.Errorf("Error loading certificate templates: %v", err)
+	}
+	if !templates.Has(templateKey) {
+		return validationErrorf("unknown template: %q", templateKey)
+	}
+	return nil
+}
+
+const studentColumns = `student_id, full_name, COALESCE(NID, ''), COALESCE(phone_no, ''), COALESCE(remark, ''), COALESCE(template_key, '')`
+
+func scanPerson(row interface{ Scan(...interface{}) error }) (*Person, error) {
+	var person Person
+	err := row.Scan(&person.StudentID, &person.FullName, &person.NID, &person.PhoneNo, &person.Remark, &person.TemplateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &person, nil
+}
+
+// GetStudent returns the student with exactly this ID
+func GetStudent(studentID string) (*Person, error) {
+	row := db.QueryRow(`SELECT `+studentColumns+` FROM students WHERE student_id = ?`, studentID)
+	person, err := scanPerson(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrStudentNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching student %s: %v", studentID, err)
+	}
+	return person, nil
+}
+
+// StudentFilter selects students for ListStudents
+type StudentFilter struct {
+	Search      string // matches part of the student ID, name or NID
+	TemplateKey string
+	CourseID    string
+	Page        int // starting at 1
+	PerPage     int
+}
+
+// ListStudents returns a page of students ordered by ID and the total number matching the filter
+func ListStudents(filter StudentFilter) ([]Person, int, error) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.Search != "" {
+		like := "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(filter.Search) + "%"
+		conditions = append(conditions, `(student_id LIKE ? OR full_name LIKE ? OR NID LIKE ?)`)
+		args = append(args, like, like, like)
+	}
+	if filter.TemplateKey != "" {
+		conditions = append(conditions, `template_key = ?`)
+		args = append(args, filter.TemplateKey)
+	}
+	if filter.CourseID != "" {
+		conditions = append(conditions, `student_id IN (SELECT student_id FROM student_courses WHERE course_id = ?)`)
+		args = append(args, filter.CourseID)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM students`+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("error counting students: %v", err)
+	}
+
+	query := `SELECT ` + studentColumns + ` FROM students` + where + ` ORDER BY student_id LIMIT ? OFFSET ?`
+	rows, err := db.Query(query, append(args, filter.PerPage, (filter.Page-1)*filter.PerPage)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error listing students: %v", err)
+	}
+	defer rows.Close()
+
+	students := []Person{}
+	for rows.Next() {
+		person, err := scanPerson(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error scanning student: %v", err)
+		}
+		students = append(students, *person)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error reading students: %v", err)
+	}
+	return students, total, nil
+}
+
+// CreateStudent validates and stores a new student, recording who added it
+func CreateStudent(person *Person, admin, clientIP string) error {
+	if err := ValidatePerson(person); err != nil {
+		return err
+	}
+	if err := validateTemplateKey(person.TemplateKey); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO students (student_id, full_name, NID, phone_no, remark, template_key)
+		VALUES (?, ?, ?, ?, '', NULLIF(?, ''))
+	`
+
+	_, err = tx.Exec(query, person.StudentID, person.FullName, person.NID, person.PhoneNo, person.TemplateKey)
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == mysqlDuplicateEntry {
+		return ErrStudentExists
+	}
+	if err != nil {
+		return fmt.Errorf("error creating student %s: %v", person.StudentID, err)
+	}
+
+	if err := recordAudit(tx, admin, AuditStudentCreate, person.StudentID, clientIP, person); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing student %s: %v", person.StudentID, err)
+	}
+	return nil
+}
+
+// StudentUpdate holds the fields to change on a student; nil fields are left as they are
+type StudentUpdate struct {
+	FullName    *string `json:"full_name"`
+	NID         *string `json:"NID"`
+	PhoneNo     *string `json:"phone_no"`
+	TemplateKey *string `json:"template_key"`
+}
+
+// UpdateStudent applies an update to a student and records the changed fields.
+// A name or template change removes the cached certificate so the next download
+// is issued under the new details.
+func UpdateStudent(studentID string, update StudentUpdate, admin, clientIP string) (*Person, error) {
+	current, err := GetStudent(studentID)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := *current
+	changes := make(map[string]Change)
+	apply := func(field string, value *string, target *string) {
+		if value != nil && *value != *target {
+			changes[field] = Change{From: *target, To: *value}
+			*target = *value
+		}
+	}
+	apply("full_name", update.FullName, &updated.FullName)
+	apply("NID", update.NID, &updated.NID)
+	apply("phone_no", update.PhoneNo, &updated.PhoneNo)
+	apply("template_key", update.TemplateKey, &updated.TemplateKey)
+
+	if len(changes) == 0 {
+		return current, nil
+	}
+	if err := ValidatePerson(&updated); err != nil {
+		return nil, err
+	}
+	if err := validateTemplateKey(updated.TemplateKey); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE students
+		SET full_name = ?, NID = ?, phone_no = ?, template_key = NULLIF(?, '')
+		WHERE student_id = ?
+	`
+
+	_, err = tx.Exec(query, updated.FullName, updated.NID, updated.PhoneNo, updated.TemplateKey, studentID)
+	if err != nil {
+		return nil, fmt.Errorf("error updating student %s: %v", studentID, err)
+	}
+
+	if err := recordAudit(tx, admin, AuditStudentUpdate, studentID, clientIP, changes); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing student %s: %v", studentID, err)
+	}
+
+	_, nameChanged := changes["full_name"]
+	_, templateChanged := changes["template_key"]
+	if nameChanged || templateChanged {
+		removeCachedCertificate(studentID)
+	}
+
+	return &updated, nil
+}
+
+// DeleteStudent removes a student and their cached certificate. Issued
+// certificates and events are kept for the record.
+func DeleteStudent(studentID, admin, clientIP string) error {
+	current, err := GetStudent(studentID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM students WHERE student_id = ?`, studentID); err != nil {
+		return fmt.Errorf("error deleting student %s: %v", studentID, err)
+	}
+
+	if err := recordAudit(tx, admin, AuditStudentDelete, studentID, clientIP, current); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing deletion of student %s: %v", studentID, err)
+	}
+
+	removeCachedCertificate(studentID)
+	log.Printf("Student %s deleted by %s\n", studentID, admin)
+	return nil
+}
+
+// Student selections for SelectStudentIDs
+const (
+	SelectAll                = "all"
+	SelectWithoutCertificate = "without-certificate" // no certificate that is currently issued
+	SelectCoursePrefix       = "course:"             // course:<course_id>
+	SelectTemplatePrefix     = "template:"           // template:<template_key>
+)
+
+// SelectStudentIDs returns the IDs of the students in a named selection, in ID order
+func SelectStudentIDs(selection string) ([]string, error) {
+	var query string
+	var args []interface{}
+
+	switch {
+	case selection == SelectAll:
+		query = `SELECT student_id FROM students ORDER BY student_id`
+	case selection == SelectWithoutCertificate:
+		query = `
+			SELECT student_id FROM students s
+			WHERE NOT EXISTS (SELECT 1 FROM certificates c WHERE c.student_id = s.student_id AND c.status = ?)
+			ORDER BY student_id
+		`
+		args = append(args, IssuanceStatusIssued)
+	case strings.HasPrefix(selection, SelectCoursePrefix):
+		query = `SELECT student_id FROM student_courses WHERE course_id = ? ORDER BY student_id`
+		args = append(args, strings.TrimPrefix(selection, SelectCoursePrefix))
+	case strings.HasPrefix(selection, SelectTemplatePrefix):
+		query = `SELECT student_id FROM students WHERE template_key = ? ORDER BY student_id`
+		args = append(args, strings.TrimPrefix(selection, SelectTemplatePrefix))
+	default:
+		return nil, fmt.Errorf("unknown selection %q (expected %s, %s, %s<id> or %s<key>)", selection,
+			SelectAll, SelectWithoutCertificate, SelectCoursePrefix, SelectTemplatePrefix)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting students: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error scanning student ID: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading student IDs: %v", err)
+	}
+	return ids, nil
+}
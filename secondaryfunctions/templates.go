@@ -0,0 +1,79 @@
+package secondaryfunctions
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/Sathimantha/goqr/certificate"
+)
+
+// fontPath is the default certificate font, relative to the assets directory
+const fontPath = "Roboto-Regular.ttf"
+
+var templateRegistry struct {
+	once     sync.Once
+	registry *certificate.Registry
+	err      error
+}
+
+// Templates returns the certificate template registry, loading it on first use
+// from ServerConfig.AssetsDir
+func Templates() (*certificate.Registry, error) {
+	templateRegistry.once.Do(func() {
+		assetsDir, err := filepath.Abs(ServerConfig.AssetsDir)
+		if err != nil {
+			templateRegistry.err = fmt.Errorf("Error resolving assets directory: %v", err)
+			return
+		}
+		outputDir, err := filepath.Abs(ServerConfig.OutputDir)
+		if err != nil {
+			templateRegistry.err = fmt.Errorf("Error resolving output directory: %v", err)
+			return
+		}
+		registry, err := certificate.LoadRegistry(assetsDir, outputDir, fontPath)
+		if err != nil {
+			templateRegistry.err = err
+			return
+		}
+
+		keyring, err := Keyring()
+		if err != nil {
+			templateRegistry.err = err
+			return
+		}
+		registry.SetKeyring(keyring)
+		registry.SetBaseURL(ServerConfig.BaseURL)
+		templateRegistry.registry = registry
+	})
+	return templateRegistry.registry, templateRegistry.err
+}
+
+// GetTemplateKey resolves the certificate template for a student. A template set
+// on the student wins, then the template of the most recent course they took.
+// An empty key means the default template.
+func GetTemplateKey(studentID string) (string, error) {
+	query := `
+		SELECT COALESCE(s.template_key, (
+			SELECT c.template_key
+			FROM student_courses sc
+			JOIN courses c ON c.course_id = sc.course_id
+			WHERE sc.student_id = s.student_id AND c.template_key IS NOT NULL
+			ORDER BY sc.enrolled_at DESC
+			LIMIT 1
+		), '')
+		FROM students s
+		WHERE s.student_id = ?
+	`
+
+	var templateKey string
+	if err := db.QueryRow(query, studentID).Scan(&templateKey); err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("student not found: %s", studentID)
+		}
+		return "", fmt.Errorf("error resolving template for student %s: %v", studentID, err)
+	}
+
+	return templateKey, nil
+}
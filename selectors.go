@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxRangeSpan limits how many IDs a single range may expand to
+const defaultMaxRangeSpan = 10000
+
+// idRange is a validated range of IDs sharing a prefix, e.g. ST001..ST010
+type idRange struct {
+	prefix     string
+	start, end int
+	width      int // digits in the start ID, so ST001 keeps its zero padding
+}
+
+// splitID separates an ID into its prefix and trailing number
+func splitID(id string) (prefix, digits string) {
+	i := len(id)
+	for i > 0 && id[i-1] >= '0' && id[i-1] <= '9' {
+		i--
+	}
+	return id[:i], id[i:]
+}
+
+// parseRange validates a range from start to end: both IDs must have the same
+// prefix and a trailing number, start must not come after end, and the range
+// may not hold more than maxSpan IDs
+func parseRange(startID, endID string, maxSpan int) (*idRange, error) {
+	startPrefix, startDigits := splitID(startID)
+	endPrefix, endDigits := splitID(endID)
+	if startDigits == "" || endDigits == "" {
+		return nil, fmt.Errorf("invalid ID range %s..%s: both IDs must end in a number", startID, endID)
+	}
+	if startPrefix != endPrefix {
+		return nil, fmt.Errorf("invalid ID range %s..%s: IDs have different prefixes", startID, endID)
+	}
+
+	start, err := strconv.Atoi(startDigits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID range %s..%s: %v", startID, endID, err)
+	}
+	end, err := strconv.Atoi(endDigits)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID range %s..%s: %v", startID, endID, err)
+	}
+	if start > end {
+		return nil, fmt.Errorf("invalid ID range %s..%s: start comes after end", startID, endID)
+	}
+	if end-start+1 > maxSpan {
+		return nil, fmt.Errorf("ID range %s..%s holds %d IDs, more than the maximum of %d", startID, endID, end-start+1, maxSpan)
+	}
+
+	r := &idRange{prefix: startPrefix, start: start, end: end, width: len(startDigits)}
+	if r.id(end) != endID {
+		return nil, fmt.Errorf("invalid ID range %s..%s: end is not padded like start", startID, endID)
+	}
+	return r, nil
+}
+
+func (r *idRange) id(n int) string {
+	return fmt.Sprintf("%s%0*d", r.prefix, r.width, n)
+}
+
+func (r *idRange) ids() []string {
+	ids := make([]string, 0, r.end-r.start+1)
+	for n := r.start; n <= r.end; n++ {
+		ids = append(ids, r.id(n))
+	}
+	return ids
+}
+
+// parseSelectorTerm expands one term of a selector: a single ID or a range.
+// Ranges are written START..END; the older START-END form is still accepted
+// when both sides share a prefix, so an ID such as CPC-0042 stays a single ID.
+func parseSelectorTerm(term string, maxSpan int) ([]string, error) {
+	if startID, endID, found := strings.Cut(term, ".."); found {
+		r, err := parseRange(strings.TrimSpace(startID), strings.TrimSpace(endID), maxSpan)
+		if err != nil {
+			return nil, err
+		}
+		return r.ids(), nil
+	}
+
+	if strings.Count(term, "-") == 1 {
+		startID, endID, _ := strings.Cut(term, "-")
+		startPrefix, startDigits := splitID(startID)
+		endPrefix, endDigits := splitID(endID)
+		if startPrefix == endPrefix && startDigits != "" && endDigits != "" {
+			r, err := parseRange(startID, endID, maxSpan)
+			if err != nil {
+				return nil, err
+			}
+			return r.ids(), nil
+		}
+	}
+
+	return []string{term}, nil
+}
+
+// parseSelector expands a comma separated list of IDs and ranges,
+// e.g. "ST001,ST005..ST010,ST020"
+func parseSelector(selector string, maxSpan int) ([]string, error) {
+	var ids []string
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		expanded, err := parseSelectorTerm(term, maxSpan)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, expanded...)
+	}
+	return ids, nil
+}
+
+// readSelectors expands every line of r as a selector. Blank lines and lines
+// starting with # are skipped.
+func readSelectors(r io.Reader, maxSpan int) ([]string, error) {
+	var ids []string
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		expanded, err := parseSelector(text, maxSpan)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		ids = append(ids, expanded...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading IDs: %v", err)
+	}
+	return ids, nil
+}
+
+// readSelectorFile expands the selectors in a file, or standard input for "-"
+func readSelectorFile(path string, maxSpan int) ([]string, error) {
+	if path == "-" {
+		return readSelectors(os.Stdin, maxSpan)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening ID file: %v", err)
+	}
+	defer file.Close()
+
+	ids, err := readSelectors(file, maxSpan)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return ids, nil
+}
+
+// uniqueIDs removes repeated IDs, keeping the first occurrence of each
+func uniqueIDs(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	unique := ids[:0]
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
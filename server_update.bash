@@ -3,5 +3,5 @@ sudo systemctl stop goqr.service
 git pull
 rm .env
 mv .env.bkp .env
-go build
+go build -ldflags "-X main.commit=$(git rev-parse --short HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
 sudo systemctl start goqr.service
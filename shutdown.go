@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sathimantha/goqr/secondaryfunctions"
+)
+
+// serverShutdown is closed when the server starts shutting down, ending the
+// WebSocket and SSE streams that would otherwise hold it open
+var serverShutdown = make(chan struct{})
+
+// shutdownServer stops accepting connections and waits, up to the configured
+// shutdown timeout, for in-flight requests, event streams and generation jobs
+// to finish. What didn't finish in time is recorded in the server_shutdown event.
+func shutdownServer(server *http.Server, reason string) {
+	timeout := secondaryfunctions.ServerConfig.ShutdownTimeout
+	log.Printf("%s, shutting down (waiting up to %s for requests and generation jobs)...", reason, timeout)
+	started := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	close(serverShutdown)
+
+	jobsStopped := make(chan error, 1)
+	go func() {
+		jobsStopped <- secondaryfunctions.StopJobWorkers(ctx)
+	}()
+
+	var unfinished []string
+	if err := server.Shutdown(ctx); err != nil {
+		unfinished = append(unfinished, fmt.Sprintf("HTTP requests: %v", err))
+	}
+
+	streamsClosed := make(chan struct{})
+	go func() {
+		eventStreams.open.Wait()
+		close(streamsClosed)
+	}()
+	select {
+	case <-streamsClosed:
+	case <-ctx.Done():
+		unfinished = append(unfinished, "event streams still open")
+	}
+
+	if err := <-jobsStopped; err != nil {
+		unfinished = append(unfinished, err.Error())
+	}
+
+	remark := fmt.Sprintf("Server shut down at %s (%s) after %s",
+		time.Now().Format(time.RFC3339), reason, time.Since(started).Round(time.Millisecond))
+	if len(unfinished) > 0 {
+		remark += "\nNot finished within the shutdown timeout: " + strings.Join(unfinished, "; ")
+	}
+	level := slog.LevelInfo
+	if len(unfinished) > 0 {
+		level = slog.LevelWarn
+	}
+	secondaryfunctions.LogEvent(context.Background(), level, "server_shutdown", remark)
+}
+
+// logFlushTimeout bounds how long exiting waits for log records to reach the
+// errors table
+const logFlushTimeout = 5 * time.Second
+
+// closeLogs writes the queued log records before the process exits
+func closeLogs() {
+	ctx, cancel := context.WithTimeout(context.Background(), logFlushTimeout)
+	defer cancel()
+	if err := secondaryfunctions.CloseLogs(ctx); err != nil {
+		log.Printf("%v", err)
+	}
+}
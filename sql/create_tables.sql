@@ -13,5 +13,101 @@ CREATE TABLE students (
     full_name VARCHAR(100) NOT NULL,
     NID VARCHAR(100),
     phone_no VARCHAR(50),
-    remark LONGTEXT
-);ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+    remark LONGTEXT,
+    template_key VARCHAR(50)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Existing databases: ALTER TABLE students ADD COLUMN template_key VARCHAR(50);
+
+CREATE TABLE courses (
+    course_id VARCHAR(50) PRIMARY KEY,
+    name VARCHAR(150) NOT NULL,
+    template_key VARCHAR(50)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE student_courses (
+    student_id VARCHAR(50) NOT NULL,
+    course_id VARCHAR(50) NOT NULL,
+    enrolled_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (student_id, course_id),
+    INDEX idx_course_id (course_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE certificates (
+    serial VARCHAR(50) PRIMARY KEY,
+    student_id VARCHAR(50) NOT NULL,
+    template_key VARCHAR(50) NOT NULL,
+    rendered_name VARCHAR(150) NOT NULL,
+    issued_at DATETIME NOT NULL,
+    content_hash CHAR(64),
+    status VARCHAR(20) NOT NULL DEFAULT 'issued',
+    supersedes VARCHAR(50),
+    superseded_by VARCHAR(50),
+    revoked_at DATETIME,
+    revoked_by VARCHAR(100),
+    revocation_reason TEXT,
+    INDEX idx_student_id (student_id),
+    INDEX idx_issued_at (issued_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Existing databases: ALTER TABLE certificates ADD COLUMN supersedes VARCHAR(50), ADD COLUMN superseded_by VARCHAR(50),
+--     ADD COLUMN revoked_at DATETIME, ADD COLUMN revoked_by VARCHAR(100), ADD COLUMN revocation_reason TEXT;
+
+CREATE TABLE events (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    student_id VARCHAR(50) NOT NULL,
+    event_type VARCHAR(20) NOT NULL,
+    timestamp DATETIME NOT NULL,
+    client_ip VARCHAR(45),
+    user_agent VARCHAR(255),
+    download_id VARCHAR(100),
+    PRIMARY KEY (id),
+    INDEX idx_student_timestamp (student_id, timestamp),
+    INDEX idx_type_timestamp (event_type, timestamp),
+    INDEX idx_timestamp (timestamp)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE audit_log (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    timestamp DATETIME NOT NULL,
+    admin VARCHAR(100) NOT NULL,
+    action VARCHAR(50) NOT NULL,
+    student_id VARCHAR(50) NOT NULL,
+    changes JSON,
+    client_ip VARCHAR(45),
+    PRIMARY KEY (id),
+    INDEX idx_student_id (student_id),
+    INDEX idx_timestamp (timestamp)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+CREATE TABLE generation_jobs (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    student_id VARCHAR(50) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    client_ip VARCHAR(45),
+    request_id VARCHAR(64),
+    run_after DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL,
+    finished_at DATETIME,
+    -- Only set while the job is queued or running, so a student has at most one active job
+    active_student_id VARCHAR(50) AS (IF(status IN ('queued', 'running'), student_id, NULL)) STORED,
+    PRIMARY KEY (id),
+    UNIQUE INDEX idx_active_student_id (active_student_id),
+    INDEX idx_status_run_after (status, run_after),
+    INDEX idx_finished_at (finished_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
+
+-- Existing databases: ALTER TABLE generation_jobs ADD COLUMN request_id VARCHAR(64) AFTER client_ip;
+
+-- Token buckets of the mysql rate limit backend, keyed by a hash of route and client IP or search term
+CREATE TABLE rate_limit_buckets (
+    bucket_key CHAR(64) NOT NULL,
+    tokens DOUBLE NOT NULL,
+    updated_at DATETIME(6) NOT NULL,
+    full_at DATETIME(6) NOT NULL,
+    PRIMARY KEY (bucket_key),
+    INDEX idx_full_at (full_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sathimantha/goqr/secondaryfunctions"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait      = 10 * time.Second    // time allowed to write a message
+	wsPongWait       = 60 * time.Second    // time allowed between pongs
+	wsPingPeriod     = wsPongWait * 9 / 10 // must be shorter than wsPongWait
+	wsMaxMessageSize = 512                 // clients only send control frames
+
+	// maxEventStreamsPerIP caps the WebSocket and SSE connections one client IP can hold open
+	maxEventStreamsPerIP = 5
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: checkWebSocketOrigin,
+}
+
+// eventStreams counts the open WebSocket and SSE connections per client IP.
+// open lets shutdown wait for them, since the HTTP server doesn't track
+// hijacked WebSocket connections.
+var eventStreams = struct {
+	sync.Mutex
+	perIP map[string]int
+	open  sync.WaitGroup
+}{
+	perIP: make(map[string]int),
+}
+
+// checkWebSocketOrigin accepts the CORS origins and the server's own host.
+// Requests without an Origin header don't come from a browser page and are allowed.
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range allowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// acceptEventStream checks a WebSocket or SSE request before it is upgraded:
+// the student must exist and the client IP must be under its connection cap.
+// It answers the request itself when it returns false; otherwise the caller
+// must call releaseEventStream when the connection closes.
+func acceptEventStream(w http.ResponseWriter, r *http.Request) (studentID string, ok bool) {
+	clientIP := getClientIP(r)
+	studentID = r.URL.Query().Get("studentId")
+	if !secondaryfunctions.ValidationPatterns.StudentID.MatchString(studentID) {
+		sendJSONError(w, "Valid student ID is required", http.StatusBadRequest)
+		return "", false
+	}
+
+	if _, err := secondaryfunctions.GetStudent(studentID); err == secondaryfunctions.ErrStudentNotFound {
+		sendJSONError(w, "Student not found", http.StatusNotFound)
+		return "", false
+	} else if err != nil {
+		remark := fmt.Sprintf("Request IP: %s | Failed to look up student for event stream: %s | Error: %v",
+			clientIP, studentID, err)
+		secondaryfunctions.LogErrorContext(r.Context(), "database_error", remark)
+		sendJSONError(w, "Internal server error", http.StatusInternalServerError)
+		return "", false
+	}
+
+	eventStreams.Lock()
+	defer eventStreams.Unlock()
+	if eventStreams.perIP[clientIP] >= maxEventStreamsPerIP {
+		remark := fmt.Sprintf("Request IP: %s | Too many event stream connections for student: %s", clientIP, studentID)
+		secondaryfunctions.LogErrorContext(r.Context(), "connection_limit", remark)
+		sendJSONError(w, "Too many connections", http.StatusTooManyRequests)
+		return "", false
+	}
+	eventStreams.perIP[clientIP]++
+	eventStreams.open.Add(1)
+	return studentID, true
+}
+
+func releaseEventStream(clientIP string) {
+	eventStreams.Lock()
+	eventStreams.perIP[clientIP]--
+	if eventStreams.perIP[clientIP] <= 0 {
+		delete(eventStreams.perIP, clientIP)
+	}
+	eventStreams.Unlock()
+	eventStreams.open.Done()
+}
+
+// websocketHandler streams a student's job events over a WebSocket, starting
+// with the current state. Job events queue on the subscription channel and a
+// single writer goroutine sends them along with pings; the reader enforces the
+// pong deadline so dead connections are dropped.
+func websocketHandler(w http.ResponseWriter, r *http.Request) {
+	studentID, ok := acceptEventStream(w, r)
+	if !ok {
+		return
+	}
+	defer releaseEventStream(getClientIP(r))
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+	eventStreamConnections.Add(1, "websocket")
+	defer eventStreamConnections.Add(-1, "websocket")
+
+	// Subscribe before reading the current state so no update is missed in between
+	events := subscribeJobEvents(studentID)
+	defer unsubscribeJobEvents(studentID, events)
+
+	current, err := currentJobEvent(studentID)
+	if err != nil {
+		log.Printf("Error fetching job state for %s: %v", studentID, err)
+	} else {
+		// Fresh subscription, so the queue has room; this only fails if it raced with a full burst
+		select {
+		case events <- current:
+		default:
+		}
+	}
+
+	done := make(chan struct{})
+	var writer sync.WaitGroup
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		websocketWriter(conn, events, done)
+	}()
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	close(done)
+	writer.Wait()
+}
+
+// websocketWriter is the only goroutine that writes to conn. It stops when the
+// reader closes done or a write fails; closing the connection then ends the
+// reader. On server shutdown it sends a going-away close frame and gives the
+// client until wsWriteWait to answer it.
+func websocketWriter(conn *websocket.Conn, events <-chan jobEvent, done <-chan struct{}) {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	shutdown := serverShutdown
+
+	for {
+		select {
+		case <-shutdown:
+			shutdown = nil
+			deadline := time.Now().Add(wsWriteWait)
+			conn.SetWriteDeadline(deadline)
+			message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server is shutting down")
+			if err := conn.WriteMessage(websocket.CloseMessage, message); err != nil {
+				conn.Close()
+				return
+			}
+			conn.SetReadDeadline(deadline)
+			ping.Stop()
+		case event := <-events:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteJSON(event); err != nil {
+				log.Printf("Failed to send WebSocket message: %v", err)
+				conn.Close()
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				conn.Close()
+				return
+			}
+		case <-done:
+			if shutdown != nil { // no close frame sent yet
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			}
+			return
+		}
+	}
+}